@@ -1,22 +1,23 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/auth"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/broadcast"
 	"github.com/jiangzhiheng/k8s-event-collector/pkg/collector"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/elasticsearch"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/election"
 	grpcserver "github.com/jiangzhiheng/k8s-event-collector/pkg/grpc/server"
 	"github.com/jiangzhiheng/k8s-event-collector/pkg/options"
 	"github.com/jiangzhiheng/k8s-event-collector/pkg/signal"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/wal"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 	"net/http"
-	"time"
-)
-
-const (
-	RESYNC = time.Minute * 5
 )
 
 func main() {
@@ -37,32 +38,96 @@ func main() {
 	if err != nil {
 		klog.Fatalf("failed to build kubernetes client,err:%s", err.Error())
 	}
-	factory := informers.NewSharedInformerFactory(clientset, RESYNC)
-	eventCollector := collector.NewEventCollector(clientset, factory, opts)
-	factory.Start(stopChan)
 
+	esClient, err := elasticsearch.NewES(opts.ESConfig())
+	if err != nil {
+		klog.Fatalf("failed to build elasticsearch client,err:%s", err.Error())
+	}
+	sinkCfg := &elasticsearch.SinkConfig{
+		DocumentMode: opts.ESDocumentMode,
+	}
+	if opts.ESBulkEnabled {
+		sinkCfg.Bulk = &elasticsearch.BulkConfig{
+			FlushActions:  opts.ESBulkActions,
+			FlushBytes:    opts.ESBulkSize,
+			FlushInterval: opts.ESBulkFlushInterval,
+			QueueSize:     opts.ESBulkQueueSize,
+			MaxRetries:    opts.ESBulkMaxRetries,
+		}
+	}
+	esSink, err := elasticsearch.NewSink(esClient, sinkCfg)
+	if err != nil {
+		klog.Fatalf("failed to init elasticsearch sink,err:%s", err.Error())
+	}
 
-	group.Go(func() error {
-		if err := eventCollector.Run(stopChan); err != nil {
-			return fmt.Errorf("eventCollector run err:%s", err.Error())
+	var eventSink sink.Sink = esSink
+	if walCfg := opts.WALConfig(); walCfg != nil {
+		walSink, err := wal.NewSink(esSink, walCfg)
+		if err != nil {
+			klog.Fatalf("failed to init write-ahead buffer,err:%s", err.Error())
 		}
-		return nil
+		eventSink = walSink
+	}
+
+	broadcaster := broadcast.New(opts.WatchBufferSize)
+	eventCollector := collector.NewEventCollector(clientset, opts, broadcaster, eventSink)
+
+	electionCfg, err := opts.ElectionConfig()
+	if err != nil {
+		klog.Fatalf("failed to build leader election configuration,err:%s", err.Error())
+	}
+	elector := election.New(clientset, electionCfg)
+
+	// 只有 leader 采集事件，失去 leader 后退出进程
+	group.Go(func() error {
+		return elector.Run(signal.Context(stopChan), func(ctx context.Context) error {
+			if err := eventCollector.Run(ctx.Done()); err != nil {
+				return fmt.Errorf("eventCollector run err:%s", err.Error())
+			}
+			return nil
+		})
 	})
 
-	// grpc server
+	// grpc server，收到停止信号后与 collector 一起退出
 	if opts.UseGRPC {
-		go grpcserver.Run()
+		if opts.GRPCAuth && opts.GRPCTLSCert == "" {
+			klog.Warning("grpcAuth is enabled without grpcTLSCert, bearer tokens are sent in plaintext")
+		}
+		grpcServer := grpcserver.NewServer(
+			opts.GRPCConfig(),
+			esClient,
+			clientset,
+			broadcaster,
+			auth.New(clientset, opts.AuthConfig()),
+			klog.Background().WithName("grpc"),
+		)
+		group.Go(func() error {
+			return grpcServer.Run(signal.Context(stopChan))
+		})
 	}
 
 	klog.Infof("starting prometheus metrics server on http://localhost:%d", opts.MetricsPort)
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		if err := elector.Healthy(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "leader: %t\n", elector.IsLeader())
+	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := eventCollector.Healthy(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	})
 	// 研究下 prometheus default register！！！
 	http.Handle("/metrics", promhttp.Handler())
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", opts.MetricsPort), nil); err != nil {
-		klog.Fatal(err)
-	}
+	go func() {
+		if err := http.ListenAndServe(fmt.Sprintf(":%d", opts.MetricsPort), nil); err != nil {
+			klog.Fatal(err)
+		}
+	}()
 
 	if err := group.Wait(); err != nil {
 		klog.Fatal(err)
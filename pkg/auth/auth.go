@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 缓存的 token 和鉴权结果的最大数量
+const cacheSize = 4096
+
+// ErrUnauthenticated 表示 token 无效或已过期
+var ErrUnauthenticated = errors.New("invalid bearer token")
+
+type Config struct {
+	Enabled bool
+	// token 需要包含的 audience，为空时使用 apiserver 的默认 audience
+	Audiences []string
+	// 认证和鉴权结果的缓存时间
+	CacheTTL time.Duration
+}
+
+// User 是通过 TokenReview 认证的调用方
+type User struct {
+	Name   string
+	UID    string
+	Groups []string
+	Extra  map[string]authenticationv1.ExtraValue
+}
+
+// Authorizer 使用 TokenReview 认证调用方，使用 SubjectAccessReview 检查调用方能否 list 某个 namespace 的事件
+type Authorizer struct {
+	client kubernetes.Interface
+	cfg    *Config
+
+	users     *cache.LRUExpireCache
+	decisions *cache.LRUExpireCache
+}
+
+// New 返回 Authorizer，未开启时返回 nil
+func New(client kubernetes.Interface, cfg *Config) *Authorizer {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &Authorizer{
+		client:    client,
+		cfg:       cfg,
+		users:     cache.NewLRUExpireCache(cacheSize),
+		decisions: cache.NewLRUExpireCache(cacheSize),
+	}
+}
+
+// Authenticate 校验 bearer token，返回 token 对应的用户
+func (a *Authorizer) Authenticate(ctx context.Context, token string) (*User, error) {
+	// 缓存中只保存 token 的哈希
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	if cached, ok := a.users.Get(key); ok {
+		if user, ok := cached.(*User); ok {
+			return user, nil
+		}
+		return nil, ErrUnauthenticated
+	}
+
+	review, err := a.client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: a.cfg.Audiences},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to review token: %v", err)
+	}
+	if !review.Status.Authenticated {
+		a.users.Add(key, false, a.cfg.CacheTTL)
+		return nil, ErrUnauthenticated
+	}
+	info := review.Status.User
+	user := &User{Name: info.Username, UID: info.UID, Groups: info.Groups, Extra: info.Extra}
+	a.users.Add(key, user, a.cfg.CacheTTL)
+	return user, nil
+}
+
+// CanListEvents 检查用户能否 list namespace 中的事件，namespace 为空表示所有 namespace
+func (a *Authorizer) CanListEvents(ctx context.Context, user *User, namespace string) (bool, error) {
+	return a.CanList(ctx, user, "", "events", namespace)
+}
+
+// CanList 检查用户能否 list namespace 中 group 下的资源，namespace 为空表示所有 namespace
+func (a *Authorizer) CanList(ctx context.Context, user *User, group, resource, namespace string) (bool, error) {
+	groups := append([]string{}, user.Groups...)
+	sort.Strings(groups)
+	key := strings.Join([]string{user.Name, user.UID, strings.Join(groups, ","), group, resource, namespace}, "/")
+	if cached, ok := a.decisions.Get(key); ok {
+		return cached.(bool), nil
+	}
+
+	review, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Name,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra(user.Extra),
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      "list",
+				Group:     group,
+				Resource:  resource,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to review access of %s: %v", user.Name, err)
+	}
+	a.decisions.Add(key, review.Status.Allowed, a.cfg.CacheTTL)
+	return review.Status.Allowed, nil
+}
+
+func extra(values map[string]authenticationv1.ExtraValue) map[string]authorizationv1.ExtraValue {
+	if values == nil {
+		return nil
+	}
+	result := make(map[string]authorizationv1.ExtraValue, len(values))
+	for k, v := range values {
+		result[k] = authorizationv1.ExtraValue(v)
+	}
+	return result
+}
+
+type userKey struct{}
+
+// WithUser 将认证后的用户保存到 context
+func WithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFrom 返回 context 中的用户，未开启认证时为 nil
+func UserFrom(ctx context.Context) *User {
+	user, _ := ctx.Value(userKey{}).(*User)
+	return user
+}
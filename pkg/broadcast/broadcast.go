@@ -0,0 +1,157 @@
+package broadcast
+
+import (
+	"errors"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/metrics"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
+	"sync"
+)
+
+var (
+	// ErrSlowConsumer 表示订阅者的缓冲已满，订阅被关闭
+	ErrSlowConsumer = errors.New("subscriber is too slow, buffer is full")
+	// ErrStopped 表示采集已经停止，例如失去 leader
+	ErrStopped = errors.New("event collection stopped")
+)
+
+// Broadcaster 将采集到的事件实时分发给所有订阅者，nil 时不分发事件。
+// 只有正在采集事件的副本（leader）是 active 的，其它副本订阅会返回 ErrStopped
+type Broadcaster struct {
+	bufferSize int
+
+	locker      sync.RWMutex
+	active      bool
+	subscribers map[*Subscription]struct{}
+}
+
+func New(bufferSize int) *Broadcaster {
+	return &Broadcaster{
+		bufferSize:  bufferSize,
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+// Subscription 是一个订阅者，缓冲满时不会阻塞发布者，而是关闭订阅
+type Subscription struct {
+	b      *Broadcaster
+	events chan *sink.Event
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+// Events 返回事件通道，订阅结束后 Done 会被关闭
+func (s *Subscription) Events() <-chan *sink.Event {
+	return s.events
+}
+
+// Done 在订阅被关闭后关闭，之后可以通过 Err 获取原因
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err 返回订阅被关闭的原因，主动 Close 时为 nil
+func (s *Subscription) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Close 取消订阅
+func (s *Subscription) Close() {
+	s.b.remove(s, nil)
+}
+
+// Start 在开始采集时调用
+func (b *Broadcaster) Start() {
+	if b == nil {
+		return
+	}
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	b.active = true
+}
+
+// Stop 在停止采集时调用，关闭所有订阅
+func (b *Broadcaster) Stop() {
+	if b == nil {
+		return
+	}
+	b.locker.Lock()
+	b.active = false
+	subscribers := make([]*Subscription, 0, len(b.subscribers))
+	for s := range b.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	b.locker.Unlock()
+
+	for _, s := range subscribers {
+		b.remove(s, ErrStopped)
+	}
+}
+
+// Subscribe 新增一个订阅者，未开始采集时返回 ErrStopped
+func (b *Broadcaster) Subscribe() (*Subscription, error) {
+	if b == nil {
+		return nil, ErrStopped
+	}
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	if !b.active {
+		return nil, ErrStopped
+	}
+	s := &Subscription{
+		b:      b,
+		events: make(chan *sink.Event, b.bufferSize),
+		done:   make(chan struct{}),
+	}
+	b.subscribers[s] = struct{}{}
+	metrics.SetWatchSubscribers(len(b.subscribers))
+	return s, nil
+}
+
+// HasSubscribers 用于没有订阅者时跳过事件的转换
+func (b *Broadcaster) HasSubscribers() bool {
+	if b == nil {
+		return false
+	}
+	b.locker.RLock()
+	defer b.locker.RUnlock()
+	return len(b.subscribers) > 0
+}
+
+// Publish 将事件发送给所有订阅者，不会阻塞
+func (b *Broadcaster) Publish(event *sink.Event) {
+	if b == nil {
+		return
+	}
+	var slow []*Subscription
+	b.locker.RLock()
+	for s := range b.subscribers {
+		select {
+		case s.events <- event:
+		default:
+			slow = append(slow, s)
+		}
+	}
+	b.locker.RUnlock()
+
+	for _, s := range slow {
+		metrics.AddWatchDroppedSubscribers()
+		b.remove(s, ErrSlowConsumer)
+	}
+}
+
+func (b *Broadcaster) remove(s *Subscription, err error) {
+	s.once.Do(func() {
+		b.locker.Lock()
+		delete(b.subscribers, s)
+		metrics.SetWatchSubscribers(len(b.subscribers))
+		b.locker.Unlock()
+		s.err = err
+		close(s.done)
+	})
+}
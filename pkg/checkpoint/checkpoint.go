@@ -0,0 +1,215 @@
+package checkpoint
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// configMapKey 是 ConfigMap 中保存 checkpoint 的 key，内容为 gzip 压缩的 JSON
+const configMapKey = "checkpoint.json.gz"
+
+// ConfigMap 的数据不能超过 1MiB，预留部分空间给元数据
+var maxConfigMapDataBytes = 900 * 1024
+
+// Checkpoint 记录已写入的事件 UID -> ResourceVersion，重启后跳过 ResourceVersion 未变化的事件
+type Checkpoint map[string]string
+
+// Store 持久化 checkpoint
+type Store interface {
+	Load(ctx context.Context) (Checkpoint, error)
+	Save(ctx context.Context, cp Checkpoint) error
+}
+
+// Config 为 checkpoint 的保存位置，File 和 ConfigMap 都为空时不保存
+type Config struct {
+	File               string
+	ConfigMapNamespace string
+	ConfigMapName      string
+	Interval           time.Duration
+}
+
+// NewStore 根据配置返回 Store，未配置时返回 nil
+func NewStore(client kubernetes.Interface, cfg *Config) Store {
+	switch {
+	case cfg.File != "":
+		return &FileStore{Path: cfg.File}
+	case cfg.ConfigMapName != "":
+		return &ConfigMapStore{Client: client, Namespace: cfg.ConfigMapNamespace, Name: cfg.ConfigMapName}
+	}
+	return nil
+}
+
+// FileStore 将 checkpoint 保存到本地文件，先写临时文件再重命名，避免写入一半时退出损坏文件
+type FileStore struct {
+	Path string
+}
+
+func (s *FileStore) Load(_ context.Context) (Checkpoint, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Checkpoint{}, nil
+		}
+		return nil, fmt.Errorf("failed to read checkpoint %s: %v", s.Path, err)
+	}
+	cp := Checkpoint{}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %v", s.Path, err)
+	}
+	return cp, nil
+}
+
+func (s *FileStore) Save(_ context.Context, cp Checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint %s: %v", s.Path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save checkpoint %s: %v", s.Path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save checkpoint %s: %v", s.Path, err)
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("failed to save checkpoint %s: %v", s.Path, err)
+	}
+	return nil
+}
+
+// ConfigMapStore 将 checkpoint 保存到 ConfigMap，多副本选主时新 leader 可以继续使用。
+// ConfigMap 最大 1MiB，压缩后每个事件约 30 字节，最多保存约 3 万个事件。
+// 超过上限时丢弃 ResourceVersion 最旧的事件，这些事件重启后会重新写入
+type ConfigMapStore struct {
+	Client    kubernetes.Interface
+	Namespace string
+	Name      string
+}
+
+func (s *ConfigMapStore) Load(ctx context.Context) (Checkpoint, error) {
+	cm, err := s.Client.CoreV1().ConfigMaps(s.Namespace).Get(ctx, s.Name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return Checkpoint{}, nil
+		}
+		return nil, fmt.Errorf("failed to get checkpoint configmap %s/%s: %v", s.Namespace, s.Name, err)
+	}
+	data, ok := cm.BinaryData[configMapKey]
+	if !ok {
+		return Checkpoint{}, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint configmap %s/%s: %v", s.Namespace, s.Name, err)
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint configmap %s/%s: %v", s.Namespace, s.Name, err)
+	}
+	cp := Checkpoint{}
+	if err := json.Unmarshal(raw, &cp); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint configmap %s/%s: %v", s.Namespace, s.Name, err)
+	}
+	return cp, nil
+}
+
+func (s *ConfigMapStore) Save(ctx context.Context, cp Checkpoint) error {
+	data, dropped, err := fit(cp, maxConfigMapDataBytes)
+	if err != nil {
+		return err
+	}
+	if dropped > 0 {
+		klog.Warningf("checkpoint of %d events exceeds the configmap size limit, dropped %d oldest events", len(cp), dropped)
+	}
+
+	configMaps := s.Client.CoreV1().ConfigMaps(s.Namespace)
+	cm, err := configMaps.Get(ctx, s.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &v1api.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: s.Name, Namespace: s.Namespace},
+			BinaryData: map[string][]byte{configMapKey: data},
+		}
+		_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+	} else if err == nil {
+		if cm.BinaryData == nil {
+			cm.BinaryData = map[string][]byte{}
+		}
+		cm.BinaryData[configMapKey] = data
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint configmap %s/%s: %v", s.Namespace, s.Name, err)
+	}
+	return nil
+}
+
+func encode(cp Checkpoint) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(w).Encode(cp); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fit 返回压缩后不超过 maxBytes 的 checkpoint，超过时按 ResourceVersion 从旧到新丢弃事件，
+// 同时返回丢弃的事件数
+func fit(cp Checkpoint, maxBytes int) ([]byte, int, error) {
+	data, err := encode(cp)
+	if err != nil || len(data) <= maxBytes {
+		return data, 0, err
+	}
+	uids := make([]string, 0, len(cp))
+	for uid := range cp {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool {
+		return newer(cp[uids[i]], cp[uids[j]])
+	})
+	keep := len(uids)
+	for len(data) > maxBytes && keep > 0 {
+		// 按压缩率估算可以保留的事件数，多留一些余量减少重新压缩的次数
+		keep = int(float64(keep) * float64(maxBytes) / float64(len(data)) * 0.95)
+		pruned := make(Checkpoint, keep)
+		for _, uid := range uids[:keep] {
+			pruned[uid] = cp[uid]
+		}
+		if data, err = encode(pruned); err != nil {
+			return nil, 0, err
+		}
+	}
+	return data, len(cp) - keep, nil
+}
+
+// newer 判断 ResourceVersion a 是否比 b 新。ResourceVersion 在 etcd 中是递增的整数，不能解析时按字符串比较
+func newer(a, b string) bool {
+	x, errA := strconv.ParseUint(a, 10, 64)
+	y, errB := strconv.ParseUint(b, 10, 64)
+	if errA == nil && errB == nil {
+		return x > y
+	}
+	return a > b
+}
@@ -0,0 +1,108 @@
+package checkpoint
+
+import (
+	"context"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func testStores(t *testing.T) map[string]Store {
+	return map[string]Store{
+		"file":      NewStore(nil, &Config{File: filepath.Join(t.TempDir(), "checkpoint.json")}),
+		"configmap": NewStore(fake.NewSimpleClientset(), &Config{ConfigMapNamespace: "default", ConfigMapName: "k8s-event-collector"}),
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			// 还没有保存过时返回空的 checkpoint
+			cp, err := store.Load(ctx)
+			if err != nil || len(cp) != 0 {
+				t.Fatalf("expected empty checkpoint, got %v, %v", cp, err)
+			}
+
+			for _, expected := range []Checkpoint{
+				{"uid-1": "100", "uid-2": "200"},
+				// 再次保存覆盖之前的内容
+				{"uid-2": "201"},
+			} {
+				if err := store.Save(ctx, expected); err != nil {
+					t.Fatalf("save failed: %v", err)
+				}
+				cp, err := store.Load(ctx)
+				if err != nil {
+					t.Fatalf("load failed: %v", err)
+				}
+				if !reflect.DeepEqual(cp, expected) {
+					t.Errorf("expected %v, got %v", expected, cp)
+				}
+			}
+		})
+	}
+}
+
+func TestNewStoreWithoutLocation(t *testing.T) {
+	if store := NewStore(nil, &Config{}); store != nil {
+		t.Errorf("expected no store, got %T", store)
+	}
+}
+
+func TestFileStoreCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatalf("write file failed: %v", err)
+	}
+	if _, err := (&FileStore{Path: path}).Load(context.Background()); err == nil {
+		t.Errorf("expected corrupted checkpoint to be reported")
+	}
+}
+
+func TestConfigMapStoreDropsOldestWhenTooLarge(t *testing.T) {
+	limit := maxConfigMapDataBytes
+	maxConfigMapDataBytes = 8 * 1024
+	defer func() { maxConfigMapDataBytes = limit }()
+
+	// 随机的 UID 几乎不能压缩，2000 个事件远超上限
+	r := rand.New(rand.NewSource(1))
+	cp := Checkpoint{}
+	for i := 0; i < 2000; i++ {
+		cp[fmt.Sprintf("%016x%016x", r.Uint64(), r.Uint64())] = strconv.Itoa(1000 + i)
+	}
+	client := fake.NewSimpleClientset()
+	store := NewStore(client, &Config{ConfigMapNamespace: "default", ConfigMapName: "k8s-event-collector"})
+	ctx := context.Background()
+	if err := store.Save(ctx, cp); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	cm, err := client.CoreV1().ConfigMaps("default").Get(ctx, "k8s-event-collector", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get configmap failed: %v", err)
+	}
+	if size := len(cm.BinaryData[configMapKey]); size > maxConfigMapDataBytes {
+		t.Errorf("saved %d bytes, more than the limit %d", size, maxConfigMapDataBytes)
+	}
+
+	saved, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if len(saved) == 0 || len(saved) == len(cp) {
+		t.Fatalf("expected part of the events to be kept, got %d", len(saved))
+	}
+	// 保留的是最新的事件
+	oldest := 1000 + len(cp) - len(saved)
+	for uid, rv := range saved {
+		if v, _ := strconv.Atoi(rv); v < oldest || cp[uid] != rv {
+			t.Fatalf("unexpected event %s with resourceVersion %s kept, oldest kept should be %d", uid, rv, oldest)
+		}
+	}
+}
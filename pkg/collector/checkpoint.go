@@ -0,0 +1,86 @@
+package collector
+
+import (
+	"context"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/checkpoint"
+	"k8s.io/klog/v2"
+)
+
+// loadCheckpoint 启动时读取上次保存的 checkpoint，informer 首次 list 到的事件中
+// ResourceVersion 未变化的不会重复写入
+func (ec *EventCollector) loadCheckpoint() {
+	if ec.checkpoint == nil {
+		return
+	}
+	cp, err := ec.checkpoint.Load(context.Background())
+	if err != nil {
+		klog.Errorf("load checkpoint failed, all existing events will be synced: %v", err)
+		return
+	}
+	ec.locker.Lock()
+	defer ec.locker.Unlock()
+	for uid, rv := range cp {
+		ec.synced[uid] = rv
+	}
+	klog.Infof("loaded checkpoint of %d events", len(cp))
+}
+
+// pruneCheckpoint 在 informer 同步后删除停机期间已经被删除的事件
+func (ec *EventCollector) pruneCheckpoint() {
+	live := map[string]bool{}
+	ec.scopeLocker.RLock()
+	for _, s := range ec.scopes {
+		for _, source := range s.sources {
+			for _, obj := range source.informer.GetStore().List() {
+				if uid, _, ok := eventMeta(obj); ok {
+					live[uid] = true
+				}
+			}
+		}
+	}
+	ec.scopeLocker.RUnlock()
+
+	ec.locker.Lock()
+	defer ec.locker.Unlock()
+	for uid := range ec.synced {
+		if !live[uid] {
+			delete(ec.synced, uid)
+		}
+	}
+}
+
+// saveCheckpoint 保存已写入的事件。先取快照再 flush sink，快照中的事件都已经交给 sink；
+// flush 成功后只保存仍然记录为已写入的事件，之前的 flush 和本次 flush 中最终写入失败的事件
+// 已经由 forgetSynced 删除
+func (ec *EventCollector) saveCheckpoint(flush bool) {
+	if ec.checkpoint == nil {
+		return
+	}
+	ec.inflight.Lock()
+	ec.locker.Lock()
+	cp := make(checkpoint.Checkpoint, len(ec.synced))
+	for uid, rv := range ec.synced {
+		cp[uid] = rv
+	}
+	ec.locker.Unlock()
+	ec.inflight.Unlock()
+
+	if flush {
+		for _, s := range ec.sinks {
+			if err := s.Flush(context.Background()); err != nil {
+				klog.Errorf("flush sink %s failed, skip saving checkpoint: %v", s.Name(), err)
+				return
+			}
+		}
+	}
+	ec.locker.Lock()
+	for uid, rv := range cp {
+		if ec.synced[uid] != rv {
+			delete(cp, uid)
+		}
+	}
+	ec.locker.Unlock()
+	if err := ec.checkpoint.Save(context.Background(), cp); err != nil {
+		klog.Errorf("save checkpoint failed: %v", err)
+	}
+}
@@ -1,16 +1,20 @@
 package collector
 
 import (
+	"context"
 	"fmt"
-	"github.com/jiangzhiheng/k8s-event-collector/pkg/elasticsearch"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/broadcast"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/checkpoint"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/enrich"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/filter"
 	"github.com/jiangzhiheng/k8s-event-collector/pkg/options"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
 	v1api "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	coreV1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
@@ -19,95 +23,168 @@ import (
 )
 
 const (
-	workNum       = 5
-	IndexNameBase = "k8s-event-collector-%s"
-)
-
-var (
-	IndexName = fmt.Sprintf(IndexNameBase, time.Now().Format("2006-01-02"))
+	workNum = 5
+	// 事件投递失败后的最大重试次数，超过后丢弃
+	maxRetries = 15
+	resync     = time.Minute * 5
+	// 停止时等待 worker 写完队列中剩余事件的最长时间，sink 不可用时写入可能一直阻塞
+	shutdownTimeout = 30 * time.Second
 )
 
 type EventCollector struct {
-	kc                kubernetes.Interface
-	factory           informers.SharedInformerFactory
-	eventLister       coreV1.EventLister
-	eventListerSynced cache.InformerSynced
+	kc   kubernetes.Interface
+	apis []string
+	// 为空时监听所有 namespace
+	namespaces        []string
+	namespaceSelector string
+	scopeLocker       sync.RWMutex
+	scopes            map[string]*scope
 	queue             workqueue.RateLimitingInterface
 	locker            sync.Mutex
-	esClient          *elasticsearch.ESClient
+	// 已写入的事件 UID -> ResourceVersion，同时监听两种 API 时用于去重
+	synced map[string]string
+	// 缓存初次同步时已经存在的事件 UID -> ResourceVersion，写入 sink 但不推送给订阅者
+	listed map[string]string
+	// syncEvent 从 markSynced 到写入失败后 forgetSynced 期间持有读锁，
+	// 保存 checkpoint 时持有写锁取快照，快照中不会有正在写入的事件
+	inflight sync.RWMutex
+	workers  sync.WaitGroup
+	// 持久化 synced，重启后跳过已经写入的事件
+	checkpoint         checkpoint.Store
+	checkpointInterval time.Duration
+	filter             *filter.Filter
+	enricher           *enrich.Enricher
+	// 实时推送给 WatchEvents 的订阅者，可以为 nil
+	broadcaster *broadcast.Broadcaster
+	sinks       []sink.Sink
 }
 
-func NewEventCollector(client kubernetes.Interface, factor informers.SharedInformerFactory, o *options.Options) *EventCollector {
-	event := factor.Core().V1().Events()
-	esClient, err := elasticsearch.NewES(&elasticsearch.ESConfig{
-		Hosts:    o.ESEndpoint,
-		Username: o.ESUsername,
-		Password: o.ESPassword,
-	})
-	if err != nil {
-		klog.Errorf("Init elastic connect failed")
-	}
-	// init index template
-	elasticsearch.InitIndexTemplate(esClient.Client)
-	// init ilm
-	elasticsearch.InitIndexILMPolicy(esClient.Client)
-
+func NewEventCollector(client kubernetes.Interface, o *options.Options, broadcaster *broadcast.Broadcaster, sinks ...sink.Sink) *EventCollector {
+	checkpointCfg := o.CheckpointConfig()
 	eventCollector := &EventCollector{
-		kc:                client,
-		factory:           factor,
-		eventLister:       event.Lister(),
-		eventListerSynced: event.Informer().HasSynced,
-		queue:             workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
-		locker:            sync.Mutex{},
-		esClient:          esClient,
-	}
-	event.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			eventCollector.enqueueEvent(obj)
-		},
-		UpdateFunc: func(old, new interface{}) {
-			newObj := new.(*v1api.Event)
-			oldObj := old.(*v1api.Event)
-			if newObj.ResourceVersion == oldObj.ResourceVersion {
-				return
-			}
-			eventCollector.enqueueEvent(newObj)
-		},
-		DeleteFunc: func(obj interface{}) {
-			eventCollector.enqueueEvent(obj)
-		},
-	})
-
+		kc:                 client,
+		apis:               o.EventAPIs(),
+		namespaces:         o.Namespaces,
+		namespaceSelector:  o.NamespaceSelector,
+		scopes:             map[string]*scope{},
+		queue:              workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		locker:             sync.Mutex{},
+		synced:             map[string]string{},
+		listed:             map[string]string{},
+		checkpoint:         checkpoint.NewStore(client, checkpointCfg),
+		checkpointInterval: checkpointCfg.Interval,
+		filter:             o.EventFilter(),
+		enricher:           enrich.New(client, o.EnrichConfig()),
+		broadcaster:        broadcaster,
+		sinks:              sinks,
+	}
+	for _, s := range sinks {
+		if as, ok := s.(sink.AsyncSink); ok {
+			as.SetFailureHandler(eventCollector.handleSinkFailure)
+		}
+	}
 	return eventCollector
 }
 
+func (ec *EventCollector) addEventHandlers(sources []*eventSource) {
+	for _, source := range sources {
+		api := source.api
+		source.informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+			AddFunc: func(obj interface{}, isInInitialList bool) {
+				if !ec.allow(obj) {
+					return
+				}
+				if isInInitialList {
+					ec.markListed(obj)
+				}
+				ec.enqueueEvent(api, obj)
+			},
+			UpdateFunc: func(old, new interface{}) {
+				_, newRV, _ := eventMeta(new)
+				_, oldRV, _ := eventMeta(old)
+				if newRV == oldRV || !ec.allow(new) {
+					return
+				}
+				ec.enqueueEvent(api, new)
+			},
+			DeleteFunc: func(obj interface{}) {
+				ec.forgetSynced(obj)
+				ec.forgetListed(obj)
+				ec.enqueueEvent(api, obj)
+			},
+		})
+	}
+}
+
 func (ec *EventCollector) Run(stopCh <-chan struct{}) error {
 	defer runtime.HandleCrash()
+	defer ec.shutdownSinks()
+	defer ec.waitWorkers()
 	defer ec.queue.ShutDown()
-	// 创建 es 索引
-	ec.esClient.CreateIndex(IndexName)
+	defer ec.stopScopes()
+	defer ec.broadcaster.Stop()
 
 	klog.Info("starting eventCollector")
-	if ok := cache.WaitForCacheSync(stopCh, ec.eventListerSynced); !ok {
+	ec.loadCheckpoint()
+	ec.enricher.Start(stopCh)
+	cacheSyncs, err := ec.startScopes(stopCh)
+	if err != nil {
+		return err
+	}
+	if ok := cache.WaitForCacheSync(stopCh, cacheSyncs...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
+	if ec.checkpoint != nil {
+		ec.pruneCheckpoint()
+		go wait.Until(func() { ec.saveCheckpoint(true) }, ec.checkpointInterval, stopCh)
+	}
+	// 缓存初次同步时已有的事件由 listed 标记，不会当作新事件推送给订阅者
+	ec.broadcaster.Start()
 	klog.Info("started eventCollector")
 
 	for i := 0; i <= workNum; i++ {
-		go wait.Until(ec.Worker, time.Minute, stopCh)
+		ec.workers.Add(1)
+		go func() {
+			defer ec.workers.Done()
+			wait.Until(ec.Worker, time.Minute, stopCh)
+		}()
 	}
 	<-stopCh
 	klog.Info("shutting down")
 	return nil
 }
 
-func (ec *EventCollector) enqueueEvent(obj interface{}) {
+// waitWorkers 等待 worker 写完队列中剩余的事件后再关闭 sink，超时后不再等待，
+// 关闭 sink 会让阻塞的写入返回错误
+func (ec *EventCollector) waitWorkers() {
+	done := make(chan struct{})
+	go func() {
+		ec.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		klog.Warningf("workers did not finish within %v, closing sinks", shutdownTimeout)
+	}
+}
+
+func (ec *EventCollector) enqueueEvent(api string, obj interface{}) {
 	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 	if err != nil {
 		runtime.HandleError(fmt.Errorf("couldn't get key for object %+v:%v", obj, err))
 		return
 	}
-	ec.queue.Add(key)
+	ec.queue.Add(sourceKey(api, key))
+}
+
+// allow 在入队前按过滤规则检查事件
+func (ec *EventCollector) allow(obj interface{}) bool {
+	event, ok := toCoreEvent(obj)
+	if !ok {
+		return true
+	}
+	return ec.filter.Allow(event)
 }
 
 func (ec *EventCollector) Worker() {
@@ -121,28 +198,120 @@ func (ec *EventCollector) processNextItem() bool {
 		return false
 	}
 
-	err := ec.syncEventToES(key.(string))
-	if err != nil {
+	defer ec.queue.Done(key)
+
+	err := ec.syncEvent(key.(string))
+	ec.handleErr(err, key)
+	return true
+}
+
+func (ec *EventCollector) handleErr(err error, key interface{}) {
+	if err == nil {
 		ec.queue.Forget(key)
-		return true
+		return
+	}
+
+	if ec.queue.NumRequeues(key) < maxRetries {
+		klog.Warningf("error syncing event %v, will retry: %v", key, err)
+		ec.queue.AddRateLimited(key)
+		return
+	}
+
+	ec.queue.Forget(key)
+	runtime.HandleError(fmt.Errorf("dropping event %v out of the queue: %v", key, err))
+}
+
+// handleSinkFailure 处理异步 sink 回调的写入失败，将事件重新放回队列
+func (ec *EventCollector) handleSinkFailure(event *sink.Event, err error) {
+	key, keyErr := cache.MetaNamespaceKeyFunc(event)
+	if keyErr != nil {
+		runtime.HandleError(fmt.Errorf("couldn't get key for event %+v:%v", event, keyErr))
+		return
+	}
+	ec.forgetSynced(event.Event)
+	// 两种 API 中是同一个事件，从第一个 API 重新读取即可
+	ec.handleErr(err, sourceKey(ec.apis[0], key))
+}
+
+// markSynced 记录事件已写入，返回 false 表示该版本已经通过另一种 API 写入过
+func (ec *EventCollector) markSynced(event *v1api.Event) bool {
+	ec.locker.Lock()
+	defer ec.locker.Unlock()
+	if ec.synced[string(event.UID)] == event.ResourceVersion {
+		return false
 	}
-	ec.queue.AddRateLimited(key)
+	ec.synced[string(event.UID)] = event.ResourceVersion
 	return true
 }
 
-func (ec *EventCollector) syncEventToES(key string) interface{} {
-	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+// markListed 记录缓存初次同步时已经存在的事件版本
+func (ec *EventCollector) markListed(obj interface{}) {
+	uid, rv, ok := eventMeta(obj)
+	if !ok {
+		return
+	}
+	ec.locker.Lock()
+	defer ec.locker.Unlock()
+	ec.listed[uid] = rv
+}
+
+// isListed 判断该版本的事件是否在缓存初次同步时就已经存在
+func (ec *EventCollector) isListed(event *v1api.Event) bool {
+	ec.locker.Lock()
+	defer ec.locker.Unlock()
+	return ec.listed[string(event.UID)] == event.ResourceVersion
+}
+
+func (ec *EventCollector) forgetListed(obj interface{}) {
+	uid, _, ok := eventMeta(obj)
+	if !ok {
+		return
+	}
+	ec.locker.Lock()
+	defer ec.locker.Unlock()
+	delete(ec.listed, uid)
+}
+
+func (ec *EventCollector) forgetSynced(obj interface{}) {
+	uid, _, ok := eventMeta(obj)
+	if !ok {
+		return
+	}
+	ec.locker.Lock()
+	defer ec.locker.Unlock()
+	delete(ec.synced, uid)
+}
+
+func (ec *EventCollector) syncEvent(key string) error {
+	api, objKey, err := splitSourceKey(key)
 	if err != nil {
 		runtime.HandleError(fmt.Errorf("invalid resource key: %s", key))
 		return nil
 	}
-	event, err := ec.eventLister.Events(namespace).Get(name)
+	namespace, name, err := cache.SplitMetaNamespaceKey(objKey)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("invalid resource key: %s", key))
+		return nil
+	}
+	source := ec.source(api, namespace)
+	if source == nil {
+		klog.V(4).Infof("namespace of event %s is no longer watched, skip", key)
+		return nil
+	}
+	event, err := source.get(namespace, name)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			klog.Infof("event %s has been deleted", key)
 			return nil
 		}
-		klog.Infof("get event failed: %v", err)
+		return fmt.Errorf("get event %s failed: %v", key, err)
+	}
+	ec.inflight.RLock()
+	defer ec.inflight.RUnlock()
+	if !ec.markSynced(event) {
+		klog.V(4).Infof("event %s version %s already synced, skip", key, event.ResourceVersion)
+		ec.forgetListed(event)
+		return nil
 	}
 	klog.Infof(
 		"event name: %s,count: %d,involvedObject_namespace: %s,involvedObject_kind: %s,involvedObject_name: %s,reason: %s,type: %s, Msg: %s, Event time:%s",
@@ -156,7 +325,61 @@ func (ec *EventCollector) syncEventToES(key string) interface{} {
 		event.Message,
 		event.LastTimestamp,
 	)
-	ec.esClient.SyncEventItem(event, IndexName)
 
+	// 补充涉及对象的元数据后推送给订阅者并分发到所有 sink。两种 API 收到的同一个事件已经由 markSynced 去重，
+	// 缓存初次同步时已有的事件只写入 sink；sink 写入失败重试时订阅者可能再次收到该事件
+	se := &sink.Event{Event: event, Enrichment: ec.enricher.Enrich(event)}
+	if !ec.isListed(event) {
+		ec.broadcaster.Publish(se)
+	}
+	var errs []error
+	for _, s := range ec.sinks {
+		if err := s.Write(context.Background(), se); err != nil {
+			errs = append(errs, fmt.Errorf("sink %s write event %s failed: %v", s.Name(), key, err))
+		}
+	}
+	if len(errs) > 0 {
+		ec.forgetSynced(event)
+		return utilerrors.NewAggregate(errs)
+	}
+	ec.forgetListed(event)
 	return nil
 }
+
+// Healthy 检查所有 sink 是否可用
+func (ec *EventCollector) Healthy(ctx context.Context) error {
+	var errs []error
+	for _, s := range ec.sinks {
+		if err := s.Healthy(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("sink %s unhealthy: %v", s.Name(), err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// closeSinks flush 并关闭所有 sink，返回是否全部成功
+func (ec *EventCollector) closeSinks() bool {
+	ok := true
+	for _, s := range ec.sinks {
+		if err := s.Flush(context.Background()); err != nil {
+			klog.Errorf("flush sink %s failed: %v", s.Name(), err)
+			ok = false
+		}
+		if err := s.Close(); err != nil {
+			klog.Errorf("close sink %s failed: %v", s.Name(), err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// shutdownSinks 关闭 sink 后保存 checkpoint。有事件没有写入时不保存，
+// 下次启动从上一次保存的 checkpoint 开始重新同步，避免跳过丢失的事件
+func (ec *EventCollector) shutdownSinks() {
+	if !ec.closeSinks() {
+		klog.Errorf("some events were not written on shutdown, skip saving checkpoint")
+		return
+	}
+	// sink 关闭前已经 flush，不需要再次 flush
+	ec.saveCheckpoint(false)
+}
@@ -0,0 +1,264 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/broadcast"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/checkpoint"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/options"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
+	v1api "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink 记录写入成功的事件和调用顺序。前 failures 次写入返回错误；
+// 写入 slow 事件时关闭 started，等待 release 关闭后才返回
+type fakeSink struct {
+	failures int
+	slow     string
+	started  chan struct{}
+	release  chan struct{}
+
+	locker sync.Mutex
+	writes []string
+	calls  []string
+}
+
+func (s *fakeSink) Name() string { return "fake" }
+
+func (s *fakeSink) Write(_ context.Context, event *sink.Event) error {
+	if event.Name == s.slow {
+		close(s.started)
+		<-s.release
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		s.calls = append(s.calls, "fail "+event.Name)
+		return errors.New("sink unavailable")
+	}
+	s.writes = append(s.writes, event.Name)
+	s.calls = append(s.calls, "write "+event.Name)
+	return nil
+}
+
+func (s *fakeSink) Flush(context.Context) error {
+	s.record("flush")
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.record("close")
+	return nil
+}
+
+func (s *fakeSink) Healthy(context.Context) error { return nil }
+
+func (s *fakeSink) record(call string) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.calls = append(s.calls, call)
+}
+
+func (s *fakeSink) written() []string {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return append([]string(nil), s.writes...)
+}
+
+func (s *fakeSink) history() []string {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// fakeStore 保存最后一次写入的 checkpoint，并把保存记录到 sink 的调用顺序中
+type fakeStore struct {
+	sink *fakeSink
+
+	locker sync.Mutex
+	saved  checkpoint.Checkpoint
+}
+
+func (f *fakeStore) Load(context.Context) (checkpoint.Checkpoint, error) {
+	return checkpoint.Checkpoint{}, nil
+}
+
+func (f *fakeStore) Save(_ context.Context, cp checkpoint.Checkpoint) error {
+	f.sink.record("save")
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	f.saved = cp
+	return nil
+}
+
+func (f *fakeStore) last() checkpoint.Checkpoint {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	return f.saved
+}
+
+func newTestEvent(name string) *v1api.Event {
+	return &v1api.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "default",
+			UID:             types.UID(name),
+			ResourceVersion: "1",
+		},
+		InvolvedObject: v1api.ObjectReference{Kind: "Pod", Namespace: "default", Name: "nginx"},
+		Reason:         "Started",
+		Count:          1,
+	}
+}
+
+// waitFor 等待 condition 成立，超时后测试失败
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func contains(names []string, name string) bool {
+	return indexOf(names, name) >= 0
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// newTestEventsV1 返回 events.k8s.io/v1 中与 newTestEvent 相同的事件
+func newTestEventsV1(name string) *eventsv1.Event {
+	return &eventsv1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "default",
+			UID:             types.UID(name),
+			ResourceVersion: "1",
+		},
+		Regarding: v1api.ObjectReference{Kind: "Pod", Namespace: "default", Name: "nginx"},
+		Reason:    "Started",
+	}
+}
+
+func TestRunDoesNotPublishListedEvents(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestEvent("listed"))
+	s := &fakeSink{}
+	b := broadcast.New(10)
+	// 提前激活以便在采集开始前订阅
+	b.Start()
+	sub, err := b.Subscribe()
+	if err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	ec := NewEventCollector(client, options.NewOptions(), b, s)
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ec.Run(stopCh)
+	}()
+	defer func() {
+		close(stopCh)
+		<-done
+	}()
+
+	waitFor(t, "listed event to be written", func() bool { return contains(s.written(), "listed") })
+	if _, err := client.CoreV1().Events("default").Create(context.Background(), newTestEvent("created"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create event failed: %v", err)
+	}
+
+	// 缓存初次同步时已有的事件只写入 sink，订阅者第一个收到的是新创建的事件
+	select {
+	case event := <-sub.Events():
+		if event.Name != "created" {
+			t.Errorf("expected subscriber to receive created event first, got %s", event.Name)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for created event")
+	}
+}
+
+func TestRunRetriesFailedWritesAndSavesCheckpointAfterClose(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestEvent("failed"), newTestEventsV1("failed"))
+	s := &fakeSink{failures: 1, slow: "slow", started: make(chan struct{}), release: make(chan struct{})}
+	store := &fakeStore{sink: s}
+	o := options.NewOptions()
+	o.EventAPI = options.EventAPIBoth
+	ec := NewEventCollector(client, o, nil, s)
+	ec.checkpoint = store
+	ec.checkpointInterval = time.Hour
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ec.Run(stopCh)
+	}()
+
+	// 第一次写入失败后重新入队并写入成功
+	waitFor(t, "failed event to be retried", func() bool { return contains(s.written(), "failed") })
+	// slow 事件写入期间停止，关闭 sink 前等待写入完成
+	if _, err := client.CoreV1().Events("default").Create(context.Background(), newTestEvent("slow"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create event failed: %v", err)
+	}
+	<-s.started
+	close(stopCh)
+	time.Sleep(100 * time.Millisecond)
+	close(s.release)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for collector to stop")
+	}
+
+	// 两种 API 收到的同一个事件只写入一次，失败的那次也算一次尝试
+	calls := s.history()
+	attempts := map[string]int{}
+	for _, call := range calls {
+		switch call {
+		case "write failed", "fail failed":
+			attempts["failed"]++
+		case "write slow", "fail slow":
+			attempts["slow"]++
+		}
+	}
+	if attempts["failed"] != 2 || attempts["slow"] != 1 {
+		t.Errorf("expected failed to be written twice and slow once, got %v in %v", attempts, calls)
+	}
+	if indexOf(calls, "fail failed") < 0 || indexOf(calls, "fail failed") > indexOf(calls, "write failed") {
+		t.Errorf("expected failed event to be written after the failure, got %v", calls)
+	}
+
+	// 关闭顺序：写完剩余事件，flush 并关闭 sink，最后保存 checkpoint
+	closeAt := indexOf(calls, "close")
+	if closeAt < 0 || indexOf(calls, "write slow") > closeAt {
+		t.Errorf("expected sink to be closed after the in-flight write, got %v", calls)
+	}
+	if calls[closeAt-1] != "flush" || len(calls) != closeAt+2 || calls[closeAt+1] != "save" {
+		t.Errorf("expected shutdown to flush, close and then save checkpoint, got %v", calls)
+	}
+	expected := checkpoint.Checkpoint{"failed": "1", "slow": "1"}
+	if cp := store.last(); !reflect.DeepEqual(cp, expected) {
+		t.Errorf("expected checkpoint %v, got %v", expected, cp)
+	}
+}
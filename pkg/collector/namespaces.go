@@ -0,0 +1,137 @@
+package collector
+
+import (
+	"fmt"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// scope 是一个 namespace 的事件 informer，namespace 为空时监听所有 namespace
+type scope struct {
+	namespace string
+	sources   []*eventSource
+	stopCh    chan struct{}
+}
+
+// startScopes 按配置启动事件 informer，返回启动时需要等待同步的 informer。
+// 使用 namespace 标签选择器时，namespace 打上或去掉标签、创建或删除时动态启停对应的 informer
+func (ec *EventCollector) startScopes(stopCh <-chan struct{}) ([]cache.InformerSynced, error) {
+	if ec.namespaceSelector == "" {
+		namespaces := ec.namespaces
+		if len(namespaces) == 0 {
+			namespaces = []string{metav1.NamespaceAll}
+		}
+		var cacheSyncs []cache.InformerSynced
+		for _, namespace := range namespaces {
+			cacheSyncs = append(cacheSyncs, ec.addScope(namespace)...)
+		}
+		return cacheSyncs, nil
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(ec.kc, resync,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = ec.namespaceSelector
+		}))
+	informer := factory.Core().V1().Namespaces().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if ns, ok := obj.(*v1api.Namespace); ok {
+				ec.addScope(ns.Name)
+			}
+		},
+		// 标签不再匹配时 informer 会收到删除事件
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err != nil {
+				runtime.HandleError(fmt.Errorf("couldn't get key for object %+v:%v", obj, err))
+				return
+			}
+			ec.removeScope(key)
+		},
+	})
+	factory.Start(stopCh)
+	if ok := cache.WaitForCacheSync(stopCh, informer.HasSynced); !ok {
+		return nil, fmt.Errorf("failed to wait for namespace cache to sync")
+	}
+
+	ec.scopeLocker.RLock()
+	defer ec.scopeLocker.RUnlock()
+	var cacheSyncs []cache.InformerSynced
+	for _, s := range ec.scopes {
+		for _, source := range s.sources {
+			cacheSyncs = append(cacheSyncs, source.informer.HasSynced)
+		}
+	}
+	return cacheSyncs, nil
+}
+
+func (ec *EventCollector) addScope(namespace string) []cache.InformerSynced {
+	ec.scopeLocker.Lock()
+	defer ec.scopeLocker.Unlock()
+	if _, ok := ec.scopes[namespace]; ok {
+		return nil
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(ec.kc, resync, informers.WithNamespace(namespace))
+	s := &scope{
+		namespace: namespace,
+		sources:   newEventSources(factory, ec.apis),
+		stopCh:    make(chan struct{}),
+	}
+	ec.addEventHandlers(s.sources)
+	ec.enricher.Watch(namespace)
+	factory.Start(s.stopCh)
+	ec.scopes[namespace] = s
+	klog.Infof("start watching events in namespace %q", namespace)
+
+	var cacheSyncs []cache.InformerSynced
+	for _, source := range s.sources {
+		cacheSyncs = append(cacheSyncs, source.informer.HasSynced)
+	}
+	return cacheSyncs
+}
+
+func (ec *EventCollector) removeScope(namespace string) {
+	ec.scopeLocker.Lock()
+	defer ec.scopeLocker.Unlock()
+	s, ok := ec.scopes[namespace]
+	if !ok {
+		return
+	}
+	close(s.stopCh)
+	delete(ec.scopes, namespace)
+	ec.enricher.StopNamespace(namespace)
+	klog.Infof("stop watching events in namespace %q", namespace)
+}
+
+func (ec *EventCollector) stopScopes() {
+	ec.scopeLocker.Lock()
+	defer ec.scopeLocker.Unlock()
+	for namespace, s := range ec.scopes {
+		close(s.stopCh)
+		delete(ec.scopes, namespace)
+	}
+}
+
+// source 返回监听该 namespace 的指定 API 的 informer
+func (ec *EventCollector) source(api, namespace string) *eventSource {
+	ec.scopeLocker.RLock()
+	defer ec.scopeLocker.RUnlock()
+	s, ok := ec.scopes[namespace]
+	if !ok {
+		s, ok = ec.scopes[metav1.NamespaceAll]
+	}
+	if !ok {
+		return nil
+	}
+	for _, source := range s.sources {
+		if source.api == api {
+			return source
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package collector
+
+import (
+	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/options"
+	v1api "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"strings"
+)
+
+// eventSource 是一个事件 API 的 informer，events.k8s.io/v1 的事件会转换为 core/v1 的事件
+type eventSource struct {
+	api      string
+	informer cache.SharedIndexInformer
+	get      func(namespace, name string) (*v1api.Event, error)
+}
+
+func newEventSources(factory informers.SharedInformerFactory, apis []string) []*eventSource {
+	var sources []*eventSource
+	for _, api := range apis {
+		switch api {
+		case options.EventAPICore:
+			event := factory.Core().V1().Events()
+			sources = append(sources, &eventSource{
+				api:      api,
+				informer: event.Informer(),
+				get: func(namespace, name string) (*v1api.Event, error) {
+					return event.Lister().Events(namespace).Get(name)
+				},
+			})
+		case options.EventAPIEvents:
+			event := factory.Events().V1().Events()
+			sources = append(sources, &eventSource{
+				api:      api,
+				informer: event.Informer(),
+				get: func(namespace, name string) (*v1api.Event, error) {
+					e, err := event.Lister().Events(namespace).Get(name)
+					if err != nil {
+						return nil, err
+					}
+					return fromEventsV1(e), nil
+				},
+			})
+		}
+	}
+	return sources
+}
+
+// sourceKey 在队列 key 前加上 API 名称，区分从不同 API 收到的同一个事件
+func sourceKey(api, key string) string {
+	return api + "/" + key
+}
+
+func splitSourceKey(key string) (string, string, error) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("unexpected key format: %q", key)
+	}
+	return parts[0], parts[1], nil
+}
+
+// eventMeta 返回 informer 回调对象的 UID 和 ResourceVersion，兼容两种 API 和 DeletedFinalStateUnknown
+func eventMeta(obj interface{}) (string, string, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	switch e := obj.(type) {
+	case *v1api.Event:
+		return string(e.UID), e.ResourceVersion, true
+	case *eventsv1.Event:
+		return string(e.UID), e.ResourceVersion, true
+	}
+	return "", "", false
+}
+
+// toCoreEvent 将 informer 回调的对象统一转换为 core/v1 的事件
+func toCoreEvent(obj interface{}) (*v1api.Event, bool) {
+	switch e := obj.(type) {
+	case *v1api.Event:
+		return e, true
+	case *eventsv1.Event:
+		return fromEventsV1(e), true
+	}
+	return nil, false
+}
+
+// fromEventsV1 将 events.k8s.io/v1 的事件转换为 core/v1 的事件，字段对应关系与 apiserver 的转换一致
+func fromEventsV1(e *eventsv1.Event) *v1api.Event {
+	event := &v1api.Event{
+		TypeMeta:            e.TypeMeta,
+		ObjectMeta:          e.ObjectMeta,
+		InvolvedObject:      e.Regarding,
+		Reason:              e.Reason,
+		Message:             e.Note,
+		Source:              e.DeprecatedSource,
+		FirstTimestamp:      e.DeprecatedFirstTimestamp,
+		LastTimestamp:       e.DeprecatedLastTimestamp,
+		Count:               e.DeprecatedCount,
+		Type:                e.Type,
+		EventTime:           e.EventTime,
+		Action:              e.Action,
+		ReportingController: e.ReportingController,
+		ReportingInstance:   e.ReportingInstance,
+	}
+	if e.Related != nil {
+		related := *e.Related
+		event.Related = &related
+	}
+	if e.Series != nil {
+		event.Series = &v1api.EventSeries{
+			Count:            e.Series.Count,
+			LastObservedTime: e.Series.LastObservedTime,
+		}
+	}
+	return event
+}
@@ -0,0 +1,93 @@
+package collector
+
+import (
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/elasticsearch"
+	v1api "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFromEventsV1(t *testing.T) {
+	first := metav1.NewTime(time.Date(2024, 4, 12, 3, 17, 16, 0, time.UTC))
+	last := metav1.NewTime(first.Add(time.Minute))
+	eventTime := metav1.NewMicroTime(first.Add(time.Second))
+	observed := metav1.NewMicroTime(last.Add(time.Second))
+	pod := v1api.ObjectReference{Kind: "Pod", Namespace: "default", Name: "web-0", UID: "pod-uid"}
+	node := v1api.ObjectReference{Kind: "Node", Name: "worker-1"}
+
+	e := &eventsv1.Event{
+		ObjectMeta:               metav1.ObjectMeta{Namespace: "default", Name: "web-0.17c56a0cb01da61c", UID: "event-uid", ResourceVersion: "42"},
+		EventTime:                eventTime,
+		Series:                   &eventsv1.EventSeries{Count: 5, LastObservedTime: observed},
+		ReportingController:      "default-scheduler",
+		ReportingInstance:        "default-scheduler-master-1",
+		Action:                   "Binding",
+		Reason:                   "Scheduled",
+		Regarding:                pod,
+		Related:                  &node,
+		Note:                     "Successfully assigned default/web-0 to worker-1",
+		Type:                     v1api.EventTypeNormal,
+		DeprecatedSource:         v1api.EventSource{Component: "default-scheduler"},
+		DeprecatedFirstTimestamp: first,
+		DeprecatedLastTimestamp:  last,
+		DeprecatedCount:          3,
+	}
+
+	expected := &v1api.Event{
+		ObjectMeta:          e.ObjectMeta,
+		InvolvedObject:      pod,
+		Reason:              "Scheduled",
+		Message:             "Successfully assigned default/web-0 to worker-1",
+		Source:              v1api.EventSource{Component: "default-scheduler"},
+		FirstTimestamp:      first,
+		LastTimestamp:       last,
+		Count:               3,
+		Type:                v1api.EventTypeNormal,
+		EventTime:           eventTime,
+		Series:              &v1api.EventSeries{Count: 5, LastObservedTime: observed},
+		Action:              "Binding",
+		Related:             &node,
+		ReportingController: "default-scheduler",
+		ReportingInstance:   "default-scheduler-master-1",
+	}
+	got := fromEventsV1(e)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected conversion:\n got: %+v\nwant: %+v", got, expected)
+	}
+	// 转换后的事件不能与原事件共享 related，避免修改 informer 缓存
+	if got.Related == e.Related {
+		t.Errorf("expected related to be copied")
+	}
+}
+
+func TestFromEventsV1WithoutOptionalFields(t *testing.T) {
+	got := fromEventsV1(&eventsv1.Event{Reason: "Killing"})
+	if got.Related != nil || got.Series != nil {
+		t.Errorf("expected related and series to stay nil, got %+v", got)
+	}
+	if got.Reason != "Killing" {
+		t.Errorf("unexpected reason %q", got.Reason)
+	}
+}
+
+func TestFromEventsV1SeriesTimestamp(t *testing.T) {
+	eventTime := metav1.NewMicroTime(time.Date(2024, 4, 12, 3, 17, 16, 0, time.UTC))
+	observed := metav1.NewMicroTime(eventTime.Add(10 * time.Minute))
+	e := &eventsv1.Event{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-0.17c56a0cb01da61c", UID: "event-uid"},
+		EventTime:  eventTime,
+		Reason:     "FailedScheduling",
+	}
+	// 第一次发生时使用 eventTime
+	if got := elasticsearch.EventTimestamp(fromEventsV1(e)); !got.Equal(eventTime.Time) {
+		t.Errorf("expected timestamp %v, got %v", eventTime.Time, got)
+	}
+	// 再次发生时 deprecatedLastTimestamp 仍为空，使用 series.lastObservedTime
+	e.Series = &eventsv1.EventSeries{Count: 2, LastObservedTime: observed}
+	if got := elasticsearch.EventTimestamp(fromEventsV1(e)); !got.Equal(observed.Time) {
+		t.Errorf("expected timestamp %v, got %v", observed.Time, got)
+	}
+}
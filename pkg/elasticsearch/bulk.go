@@ -0,0 +1,421 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/metrics"
+	"k8s.io/klog/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrBulkIndexerClosed = errors.New("bulk indexer is closed")
+
+// BulkItemError 是 bulk 响应中单个文档的错误
+type BulkItemError struct {
+	Status int
+	Type   string
+	Reason string
+}
+
+func (e *BulkItemError) Error() string {
+	return fmt.Sprintf("[%d] %s: %s", e.Status, e.Type, e.Reason)
+}
+
+// IsRetryable 判断写入失败的文档重新投递后是否可能成功，
+// 映射错误等 4xx 错误重试也不会成功
+func IsRetryable(err error) bool {
+	if errors.Is(err, ErrBulkIndexerClosed) {
+		return false
+	}
+	var itemErr *BulkItemError
+	if errors.As(err, &itemErr) {
+		return isRetryableStatus(itemErr.Status)
+	}
+	return true
+}
+
+type BulkConfig struct {
+	// 触发 flush 的条件，任意一个满足即写出
+	FlushActions  int
+	FlushBytes    int
+	FlushInterval time.Duration
+	// 等待进入批次的文档数上限，队列满时 Add 会阻塞，从而把压力反馈给 workqueue
+	QueueSize int
+	// 单个文档因 429/5xx 失败时的最大重试次数
+	MaxRetries int
+}
+
+func DefaultBulkConfig() *BulkConfig {
+	return &BulkConfig{
+		FlushActions:  500,
+		FlushBytes:    5 * 1024 * 1024,
+		FlushInterval: 5 * time.Second,
+		QueueSize:     1000,
+		MaxRetries:    3,
+	}
+}
+
+type BulkItem struct {
+	Index      string
+	DocumentID string
+	// 为空时使用 index
+	OpType string
+	Body   []byte
+	// 文档最终写入失败时回调
+	OnFailure func(err error)
+}
+
+type bulkEntry struct {
+	item     *BulkItem
+	attempts int
+	// 同一文档有更新的版本等待写入，该条目不再写入
+	superseded bool
+}
+
+func (e *bulkEntry) key() string {
+	if e.item.DocumentID == "" {
+		return ""
+	}
+	return e.item.Index + "/" + e.item.DocumentID
+}
+
+type bulkFlushRequest struct {
+	ctx  context.Context
+	done chan error
+}
+
+// BulkIndexer 基于 _bulk 接口批量写入文档
+type BulkIndexer struct {
+	client  *ESClient
+	cfg     *BulkConfig
+	items   chan *BulkItem
+	flushCh chan *bulkFlushRequest
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+	once    sync.Once
+
+	pending      []*bulkEntry
+	pendingBytes int
+	// pending 中每个文档 ID 最新的条目，latest 模式下重试的旧版本不能覆盖新版本
+	latest map[string]*bulkEntry
+	// 有文档需要重试时，在该时间之前不再发起 flush
+	backoffUntil time.Time
+	// 关闭时有文档没有写入，Close 返回该错误
+	closeErr error
+}
+
+func NewBulkIndexer(client *ESClient, cfg *BulkConfig) *BulkIndexer {
+	if cfg == nil {
+		cfg = DefaultBulkConfig()
+	}
+	b := &BulkIndexer{
+		client:  client,
+		cfg:     cfg,
+		items:   make(chan *BulkItem, cfg.QueueSize),
+		flushCh: make(chan *bulkFlushRequest),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+		latest:  map[string]*bulkEntry{},
+	}
+	go b.run()
+	return b
+}
+
+// Add 将文档加入批次，队列满时阻塞直到有空位或 ctx 结束
+func (b *BulkIndexer) Add(ctx context.Context, item *BulkItem) error {
+	select {
+	case <-b.stopCh:
+		return ErrBulkIndexerClosed
+	default:
+	}
+
+	select {
+	case b.items <- item:
+		metrics.SetBulkQueueLength(len(b.items))
+		return nil
+	case <-b.stopCh:
+		return ErrBulkIndexerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush 写出当前所有已入队的文档
+func (b *BulkIndexer) Flush(ctx context.Context) error {
+	req := &bulkFlushRequest{ctx: ctx, done: make(chan error, 1)}
+	select {
+	case b.flushCh <- req:
+	case <-b.doneCh:
+		return ErrBulkIndexerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close 停止接收新文档，写出剩余文档后返回，有文档没有写入时返回错误
+func (b *BulkIndexer) Close() error {
+	b.once.Do(func() {
+		close(b.stopCh)
+	})
+	<-b.doneCh
+	return b.closeErr
+}
+
+func (b *BulkIndexer) run() {
+	defer close(b.doneCh)
+
+	ticker := time.NewTicker(b.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		// 批次已满且处于退避期时暂停接收，Add 会在队列满后阻塞
+		items := b.items
+		if b.shouldFlush() {
+			items = nil
+		}
+		select {
+		case item := <-items:
+			b.append(&bulkEntry{item: item})
+			if b.shouldFlush() && b.canFlush() {
+				b.flush(context.Background())
+			}
+		case <-ticker.C:
+			if b.canFlush() {
+				b.flush(context.Background())
+			}
+		case req := <-b.flushCh:
+			b.drain()
+			req.done <- b.flush(req.ctx)
+		case <-b.stopCh:
+			b.drain()
+			if err := b.flush(context.Background()); err != nil {
+				klog.Errorf("bulk indexer flush on close failed: %v", err)
+			}
+			if n := b.failPending(ErrBulkIndexerClosed); n > 0 {
+				b.closeErr = fmt.Errorf("%d documents were not written before the bulk indexer closed", n)
+			}
+			return
+		}
+	}
+}
+
+// append 将条目加入批次，同一文档之前的条目被替换。重试的条目总是在下一批次的新文档之前加入，
+// 因此被替换的一定是旧版本
+func (b *BulkIndexer) append(entry *bulkEntry) {
+	if key := entry.key(); key != "" {
+		if prev, ok := b.latest[key]; ok {
+			prev.superseded = true
+			b.pendingBytes -= len(prev.item.Body)
+		}
+		b.latest[key] = entry
+	}
+	b.pending = append(b.pending, entry)
+	b.pendingBytes += len(entry.item.Body)
+}
+
+// takePending 取出批次中所有未被替换的条目
+func (b *BulkIndexer) takePending() []*bulkEntry {
+	entries := make([]*bulkEntry, 0, len(b.pending))
+	for _, entry := range b.pending {
+		if !entry.superseded {
+			entries = append(entries, entry)
+		}
+	}
+	b.pending = nil
+	b.pendingBytes = 0
+	b.latest = map[string]*bulkEntry{}
+	return entries
+}
+
+func (b *BulkIndexer) drain() {
+	for {
+		select {
+		case item := <-b.items:
+			b.append(&bulkEntry{item: item})
+		default:
+			return
+		}
+	}
+}
+
+func (b *BulkIndexer) shouldFlush() bool {
+	if b.cfg.FlushActions > 0 && len(b.pending) >= b.cfg.FlushActions {
+		return true
+	}
+	if b.cfg.FlushBytes > 0 && b.pendingBytes >= b.cfg.FlushBytes {
+		return true
+	}
+	return false
+}
+
+func (b *BulkIndexer) canFlush() bool {
+	return time.Now().After(b.backoffUntil)
+}
+
+// failPending 放弃批次中的所有文档，返回放弃的文档数
+func (b *BulkIndexer) failPending(err error) int {
+	entries := b.takePending()
+	for _, entry := range entries {
+		b.fail(entry, err)
+	}
+	return len(entries)
+}
+
+func (b *BulkIndexer) fail(entry *bulkEntry, err error) {
+	metrics.AddBulkItems(metrics.BulkResultFailed, 1)
+	if entry.item.OnFailure != nil {
+		entry.item.OnFailure(err)
+		return
+	}
+	klog.Errorf("bulk index document into %s failed: %v", entry.item.Index, err)
+}
+
+// flush 发送一次 _bulk 请求，可重试的文档保留到下一批。只有存在需要重试的文档时返回错误，
+// 映射错误等永久失败的文档交给 OnFailure 处理，不返回错误，避免调用方反复投递同一批文档
+func (b *BulkIndexer) flush(ctx context.Context) error {
+	metrics.SetBulkQueueLength(len(b.items))
+	entries := b.takePending()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		action := map[string]interface{}{
+			"_index": entry.item.Index,
+		}
+		if entry.item.DocumentID != "" {
+			action["_id"] = entry.item.DocumentID
+		}
+		opType := entry.item.OpType
+		if opType == "" {
+			opType = OpTypeIndex
+		}
+		meta, err := json.Marshal(map[string]interface{}{
+			opType: action,
+		})
+		if err != nil {
+			return err
+		}
+		buf.Write(meta)
+		buf.WriteByte('\n')
+		buf.Write(entry.item.Body)
+		buf.WriteByte('\n')
+	}
+
+	start := time.Now()
+	results, err := b.do(ctx, &buf)
+	metrics.ObserveBulkFlush(len(entries), time.Since(start))
+	if err != nil {
+		// 整个请求失败，所有文档都按可重试处理
+		klog.Errorf("bulk request with %d documents failed: %v", len(entries), err)
+		for _, entry := range entries {
+			b.retry(entry, err)
+		}
+		b.backoffUntil = time.Now().Add(b.cfg.FlushInterval)
+		return err
+	}
+
+	var retried int
+	defer func() {
+		if retried > 0 {
+			b.backoffUntil = time.Now().Add(b.cfg.FlushInterval)
+		}
+	}()
+	for i, entry := range entries {
+		if i >= len(results) {
+			b.retry(entry, fmt.Errorf("missing item in bulk response"))
+			retried++
+			continue
+		}
+		result := results[i]
+		// op_type=create 时 409 表示文档已经写入过
+		if result.Status >= 200 && result.Status < 300 ||
+			entry.item.OpType == OpTypeCreate && result.Status == http.StatusConflict {
+			metrics.AddBulkItems(metrics.BulkResultSuccess, 1)
+			continue
+		}
+		itemErr := &BulkItemError{Status: result.Status, Type: result.Error.Type, Reason: result.Error.Reason}
+		if isRetryableStatus(result.Status) {
+			b.retry(entry, itemErr)
+			retried++
+		} else {
+			b.fail(entry, itemErr)
+		}
+	}
+	if retried > 0 {
+		return fmt.Errorf("%d of %d documents failed in bulk request and will be retried", retried, len(entries))
+	}
+	return nil
+}
+
+func (b *BulkIndexer) retry(entry *bulkEntry, err error) {
+	entry.attempts++
+	if entry.attempts > b.cfg.MaxRetries {
+		b.fail(entry, err)
+		return
+	}
+	metrics.AddBulkItems(metrics.BulkResultRetried, 1)
+	b.append(entry)
+}
+
+type bulkResponseItem struct {
+	Index  string `json:"_index"`
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkResponseItem `json:"items"`
+}
+
+func (b *BulkIndexer) do(ctx context.Context, body *bytes.Buffer) ([]bulkResponseItem, error) {
+	req := esapi.BulkRequest{
+		Body: body,
+	}
+	res, err := req.Do(ctx, b.client.transport)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("bulk request failed: %s", res.String())
+	}
+
+	var r bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("error parsing the bulk response body: %s", err)
+	}
+
+	results := make([]bulkResponseItem, 0, len(r.Items))
+	for _, item := range r.Items {
+		// 每个 item 只有一个 key，即 action 名称
+		for _, result := range item {
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
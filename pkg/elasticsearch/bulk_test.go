@@ -0,0 +1,371 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/wal"
+	v1api "k8s.io/api/core/v1"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bulkAction 是 _bulk 请求中的一个文档
+type bulkAction struct {
+	OpType string
+	Index  string
+	ID     string
+	Body   string
+}
+
+// bulkServer 模拟 _bulk 接口，status 返回每个文档的状态码
+type bulkServer struct {
+	status func(request int, action bulkAction) int
+
+	locker   sync.Mutex
+	requests [][]bulkAction
+}
+
+func newBulkServer(t *testing.T, status func(request int, action bulkAction) int) (*bulkServer, *ESClient) {
+	b := &bulkServer{status: status}
+	srv := httptest.NewServer(http.HandlerFunc(b.handle))
+	t.Cleanup(srv.Close)
+	client, err := NewES(&ESConfig{Hosts: []string{srv.URL}, Index: DefaultIndexConfig()})
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+	return b, client
+}
+
+func (b *bulkServer) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	if r.URL.Path != "/_bulk" {
+		fmt.Fprint(w, `{"version":{"number":"7.17.10","build_flavor":"default"},"tagline":"You Know, for Search"}`)
+		return
+	}
+
+	var actions []bulkAction
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var meta map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &meta); err != nil || !scanner.Scan() {
+			http.Error(w, "malformed bulk body", http.StatusBadRequest)
+			return
+		}
+		for opType, m := range meta {
+			actions = append(actions, bulkAction{OpType: opType, Index: m.Index, ID: m.ID, Body: scanner.Text()})
+		}
+	}
+
+	b.locker.Lock()
+	request := len(b.requests)
+	b.requests = append(b.requests, actions)
+	b.locker.Unlock()
+
+	var items []map[string]interface{}
+	for _, action := range actions {
+		status := b.status(request, action)
+		result := map[string]interface{}{"_index": action.Index, "_id": action.ID, "status": status}
+		if status >= 300 {
+			result["error"] = map[string]string{"type": "test_exception", "reason": fmt.Sprintf("status %d", status)}
+		}
+		items = append(items, map[string]interface{}{action.OpType: result})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": true, "items": items})
+}
+
+func (b *bulkServer) received() [][]bulkAction {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return append([][]bulkAction(nil), b.requests...)
+}
+
+func testBulkConfig() *BulkConfig {
+	return &BulkConfig{
+		FlushActions:  100,
+		FlushInterval: time.Hour,
+		QueueSize:     100,
+		MaxRetries:    3,
+	}
+}
+
+func TestBulkRetryDoesNotOverwriteNewerVersion(t *testing.T) {
+	srv, client := newBulkServer(t, func(request int, action bulkAction) int {
+		if request == 0 {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	})
+	b := NewBulkIndexer(client, testBulkConfig())
+	defer b.Close()
+
+	ctx := context.Background()
+	if err := b.Add(ctx, &BulkItem{Index: "events", DocumentID: "uid", Body: []byte(`{"Count":1}`)}); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if err := b.Flush(ctx); err == nil {
+		t.Fatalf("expected the first flush to report the rejected document")
+	}
+	// 重试期间事件更新，旧版本不能再写入
+	if err := b.Add(ctx, &BulkItem{Index: "events", DocumentID: "uid", Body: []byte(`{"Count":2}`)}); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if err := b.Flush(ctx); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	requests := srv.received()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 bulk requests, got %d", len(requests))
+	}
+	if len(requests[1]) != 1 || requests[1][0].Body != `{"Count":2}` {
+		t.Errorf("expected only the newer version to be retried, got %+v", requests[1])
+	}
+}
+
+func TestBulkCloseReportsUnwrittenDocuments(t *testing.T) {
+	_, client := newBulkServer(t, func(int, bulkAction) int {
+		return http.StatusServiceUnavailable
+	})
+	b := NewBulkIndexer(client, testBulkConfig())
+
+	var failure error
+	item := &BulkItem{Index: "events", DocumentID: "uid", Body: []byte(`{}`), OnFailure: func(err error) { failure = err }}
+	if err := b.Add(context.Background(), item); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	// 关闭时写入失败的文档不能当作已经写入，调用方据此跳过保存 checkpoint
+	if err := b.Close(); err == nil {
+		t.Errorf("expected close to report the unwritten document")
+	}
+	if !errors.Is(failure, ErrBulkIndexerClosed) {
+		t.Errorf("expected document to fail with %v, got %v", ErrBulkIndexerClosed, failure)
+	}
+}
+
+func TestWALCommitsPastRejectedDocuments(t *testing.T) {
+	rejected := testEvent()
+	accepted := testEvent()
+	accepted.Name, accepted.UID = "argocd-server-7965b94c48-z99hk.17c56a0cb01da61d", "0d1c5b7e-3c2f-4f6e-8a63-1f0b8e7c9a42"
+
+	srv, client := newBulkServer(t, func(_ int, action bulkAction) int {
+		// 映射冲突等错误重试也不会成功
+		if action.ID == string(rejected.UID) {
+			return http.StatusBadRequest
+		}
+		return http.StatusCreated
+	})
+	esSink, err := NewSink(client, &SinkConfig{DocumentMode: DocumentModeLatest, Bulk: testBulkConfig()})
+	if err != nil {
+		t.Fatalf("create sink failed: %v", err)
+	}
+	w, err := wal.NewSink(esSink, &wal.Config{
+		Dir:           t.TempDir(),
+		MaxBytes:      1024 * 1024,
+		SegmentBytes:  1024 * 1024,
+		BatchSize:     10,
+		RetryInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("create wal failed: %v", err)
+	}
+	defer w.Close()
+
+	ctx := context.Background()
+	for _, event := range []*v1api.Event{rejected, accepted} {
+		if err := w.Write(ctx, &sink.Event{Event: event}); err != nil {
+			t.Fatalf("write event failed: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("buffered events were not delivered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 被拒绝的文档不能阻塞缓冲区，之后不应再重复投递
+	time.Sleep(200 * time.Millisecond)
+	requests := srv.received()
+	if len(requests) != 1 || len(requests[0]) != 2 {
+		t.Errorf("expected a single bulk request with both events, got %+v", requests)
+	}
+}
+
+func waitForRequests(t *testing.T, srv *bulkServer, n int) [][]bulkAction {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if requests := srv.received(); len(requests) >= n {
+			return requests
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d bulk requests, got %d", n, len(srv.received()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBulkFlushTriggers(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  func(cfg *BulkConfig)
+	}{
+		{"actions", func(cfg *BulkConfig) { cfg.FlushActions = 2 }},
+		{"bytes", func(cfg *BulkConfig) { cfg.FlushBytes = 16 }},
+		{"interval", func(cfg *BulkConfig) { cfg.FlushInterval = 50 * time.Millisecond }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv, client := newBulkServer(t, func(int, bulkAction) int { return http.StatusOK })
+			cfg := testBulkConfig()
+			test.cfg(cfg)
+			b := NewBulkIndexer(client, cfg)
+			defer b.Close()
+
+			for _, id := range []string{"a", "b"} {
+				if err := b.Add(context.Background(), &BulkItem{Index: "events", DocumentID: id, Body: []byte(`{"k":"v"}`)}); err != nil {
+					t.Fatalf("add failed: %v", err)
+				}
+			}
+			requests := waitForRequests(t, srv, 1)
+			if len(requests[0]) != 2 {
+				t.Errorf("expected both documents in one request, got %+v", requests[0])
+			}
+		})
+	}
+}
+
+func TestBulkRetriesOnlyRetryableItems(t *testing.T) {
+	srv, client := newBulkServer(t, func(request int, action bulkAction) int {
+		switch {
+		case action.ID == "conflict":
+			return http.StatusBadRequest
+		case action.ID == "busy" && request == 0:
+			return http.StatusTooManyRequests
+		}
+		return http.StatusCreated
+	})
+	b := NewBulkIndexer(client, testBulkConfig())
+	defer b.Close()
+
+	failures := map[string]error{}
+	var locker sync.Mutex
+	add := func(id string) {
+		item := &BulkItem{Index: "events", DocumentID: id, Body: []byte(`{}`), OnFailure: func(err error) {
+			locker.Lock()
+			defer locker.Unlock()
+			failures[id] = err
+		}}
+		if err := b.Add(context.Background(), item); err != nil {
+			t.Fatalf("add failed: %v", err)
+		}
+	}
+	for _, id := range []string{"ok", "busy", "conflict"} {
+		add(id)
+	}
+
+	ctx := context.Background()
+	if err := b.Flush(ctx); err == nil {
+		t.Errorf("expected flush to report the document that will be retried")
+	}
+	if err := b.Flush(ctx); err != nil {
+		t.Errorf("expected the retried document to succeed, got %v", err)
+	}
+
+	requests := srv.received()
+	if len(requests) != 2 || len(requests[1]) != 1 || requests[1][0].ID != "busy" {
+		t.Errorf("expected only the 429 document to be retried, got %+v", requests)
+	}
+	locker.Lock()
+	defer locker.Unlock()
+	var itemErr *BulkItemError
+	if len(failures) != 1 || !errors.As(failures["conflict"], &itemErr) || IsRetryable(itemErr) {
+		t.Errorf("expected only the 400 document to fail permanently, got %v", failures)
+	}
+}
+
+func TestBulkGivesUpAfterMaxRetries(t *testing.T) {
+	srv, client := newBulkServer(t, func(int, bulkAction) int { return http.StatusServiceUnavailable })
+	cfg := testBulkConfig()
+	cfg.MaxRetries = 2
+	b := NewBulkIndexer(client, cfg)
+	defer b.Close()
+
+	var failure error
+	item := &BulkItem{Index: "events", DocumentID: "uid", Body: []byte(`{}`), OnFailure: func(err error) { failure = err }}
+	if err := b.Add(context.Background(), item); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	for i := 0; i <= cfg.MaxRetries; i++ {
+		b.Flush(context.Background())
+	}
+	// 重试次数用完后不再写入，交给 OnFailure，由调用方重新投递
+	if err := b.Flush(context.Background()); err != nil {
+		t.Errorf("expected nothing left to flush, got %v", err)
+	}
+	if n := len(srv.received()); n != cfg.MaxRetries+1 {
+		t.Errorf("expected %d attempts, got %d", cfg.MaxRetries+1, n)
+	}
+	if !IsRetryable(failure) {
+		t.Errorf("expected a retryable failure to be handed back, got %v", failure)
+	}
+}
+
+func TestBulkBacksOffAfterRetryableFailure(t *testing.T) {
+	srv, client := newBulkServer(t, func(request int, _ bulkAction) int {
+		if request == 0 {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	})
+	cfg := testBulkConfig()
+	cfg.FlushInterval = 200 * time.Millisecond
+	b := NewBulkIndexer(client, cfg)
+	defer b.Close()
+
+	start := time.Now()
+	if err := b.Add(context.Background(), &BulkItem{Index: "events", DocumentID: "uid", Body: []byte(`{}`)}); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	requests := waitForRequests(t, srv, 2)
+	// 第一次在定时 flush 时写入，失败后至少再等待一个 FlushInterval 才重试
+	if elapsed := time.Since(start); elapsed < 2*cfg.FlushInterval {
+		t.Errorf("retried after %v, expected backoff of at least %v", elapsed, 2*cfg.FlushInterval)
+	}
+	if len(requests[1]) != 1 || requests[1][0].ID != "uid" {
+		t.Errorf("expected the document to be retried, got %+v", requests[1])
+	}
+}
+
+func TestBulkCloseFlushesPendingDocuments(t *testing.T) {
+	srv, client := newBulkServer(t, func(int, bulkAction) int { return http.StatusOK })
+	b := NewBulkIndexer(client, testBulkConfig())
+
+	if err := b.Add(context.Background(), &BulkItem{Index: "events", DocumentID: "uid", Body: []byte(`{}`)}); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if requests := srv.received(); len(requests) != 1 || len(requests[0]) != 1 {
+		t.Errorf("expected pending document to be flushed on close, got %+v", requests)
+	}
+	if err := b.Add(context.Background(), &BulkItem{Index: "events", Body: []byte(`{}`)}); !errors.Is(err, ErrBulkIndexerClosed) {
+		t.Errorf("expected %v after close, got %v", ErrBulkIndexerClosed, err)
+	}
+	if err := b.Flush(context.Background()); !errors.Is(err, ErrBulkIndexerClosed) {
+		t.Errorf("expected %v after close, got %v", ErrBulkIndexerClosed, err)
+	}
+}
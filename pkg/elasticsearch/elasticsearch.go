@@ -3,270 +3,400 @@ package elasticsearch
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
+	"io"
 	v1api "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
+	"net/http"
+	"os"
 	"strings"
-	"time"
 )
 
 type ESConfig struct {
 	Hosts    []string `yaml:"hosts"`
 	Username string   `yaml:"username"`
 	Password string   `yaml:"password"`
+	// Elastic Cloud 部署 ID，与 Hosts 二选一
+	CloudID string `yaml:"cloudID"`
+	// 设置后优先于用户名密码认证
+	APIKey       string `yaml:"apiKey"`
+	ServiceToken string `yaml:"serviceToken"`
+	// TLS 配置，CA 证书追加到系统证书池中
+	CACertFile         string `yaml:"caCertFile"`
+	ClientCertFile     string `yaml:"clientCertFile"`
+	ClientKeyFile      string `yaml:"clientKeyFile"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	// 后端发行版：auto、elasticsearch 或 opensearch，auto 时启动后探测
+	Distribution string `yaml:"distribution"`
+	// 不探测时使用的后端版本，例如 7.17.0
+	ServerVersion string `yaml:"serverVersion"`
+	// 索引、模板和 ILM 策略配置
+	Index IndexConfig `yaml:"index"`
 }
 
 type ESClient struct {
-	Client *elasticsearch.Client
-	cfg    *ESConfig
+	cfg *ESConfig
+	// 所有请求都通过 transport 发送，按探测到的后端版本处理兼容性，不对外暴露底层 client
+	transport esapi.Transport
+	api       *esapi.API
+	detector  *serverDetector
 }
 
 func NewES(cfg *ESConfig) (*ESClient, error) {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+	httpTransport.TLSClientConfig = tlsConfig
+
 	client, err := elasticsearch.NewClient(elasticsearch.Config{
-		Addresses: cfg.Hosts,
-		Username:  cfg.Username,
-		Password:  cfg.Password,
+		Addresses:    cfg.Hosts,
+		Username:     cfg.Username,
+		Password:     cfg.Password,
+		CloudID:      cfg.CloudID,
+		APIKey:       cfg.APIKey,
+		ServiceToken: cfg.ServiceToken,
+		Transport:    httpTransport,
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	detector := &serverDetector{client: client, cfg: cfg}
+	transport := &compatTransport{client: client, detector: detector}
 	return &ESClient{
-		Client: client,
-		cfg:    cfg,
+		cfg:       cfg,
+		transport: transport,
+		api:       esapi.New(transport),
+		detector:  detector,
 	}, nil
 }
 
-func (c *ESClient) checkIndexIsExists(indexName string) bool {
+// Server 返回后端的发行版和版本
+func (c *ESClient) Server(ctx context.Context) (*ServerInfo, error) {
+	return c.detector.get(ctx)
+}
+
+func newTLSConfig(cfg *ESConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CACertFile != "" {
+		caCert, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read es ca cert: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid certificate found in %s", cfg.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCertFile != "" || cfg.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load es client cert: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func (c *ESClient) checkIndexIsExists(indexName string) (bool, error) {
 	// 检查索引是否存在
 	existsReq := esapi.IndicesExistsRequest{
 		Index: []string{indexName},
 	}
 
-	existsRes, err := existsReq.Do(context.Background(), c.Client)
+	existsRes, err := existsReq.Do(context.Background(), c.transport)
 	if err != nil {
-		klog.Errorf("Error checking index existence: %s", err)
-		return false
+		return false, fmt.Errorf("error checking index existence: %s", err)
 	}
 	defer existsRes.Body.Close()
 
-	if existsRes.IsError() {
-		klog.Errorf("Error checking index existence: %s", existsRes.String())
-		return false
-	}
-
-	if existsRes.StatusCode == 200 {
-		return true
+	switch existsRes.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("error checking index existence: %s", existsRes.String())
 	}
-
-	return false
 }
 
-func (c *ESClient) CreateIndex(indexName string) {
+func (c *ESClient) CreateIndex(indexName string) error {
+	info, err := c.Server(context.Background())
+	if err != nil {
+		return err
+	}
 	// check index
-	if c.checkIndexIsExists(indexName) {
+	exists, err := c.checkIndexIsExists(indexName)
+	if err != nil {
+		return err
+	}
+	if exists {
 		klog.Infof("Index %s already exists, skipping creation", indexName)
-		return
+		return nil
 	}
 	req := esapi.IndicesCreateRequest{
 		Index: indexName,
-		Body:  strings.NewReader(fmt.Sprintf(CreateIndexEventDocumentBody, IndexILMName, indexName)),
+		Body:  jsonBody(c.cfg.Index.CreateIndexBody(!info.IsOpenSearch())),
 	}
-	res, err := req.Do(context.Background(), c.Client)
+	res, err := req.Do(context.Background(), c.transport)
 	if err != nil {
-		klog.Fatalf("Error creating the index: %s", err)
+		return fmt.Errorf("error creating the index: %s", err)
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		klog.Fatalf("Error creating the index: %s", res.String())
+		// 多个副本同时创建时，索引可能已被其它副本创建
+		if strings.Contains(res.String(), "resource_already_exists_exception") {
+			klog.Infof("Index %s already exists, skipping creation", indexName)
+			return nil
+		}
+		return fmt.Errorf("error creating the index: %s", res.String())
 	}
 	klog.Infof("index %s Create successfully", indexName)
+	return nil
 }
 
-func (c *ESClient) SyncEventItem(event *v1api.Event, indexName string) {
-	eventDoc := EventDocument{
-		Name:                    event.Name,
-		Kind:                    event.Kind,
-		Count:                   int64(event.Count),
-		InvolvedObjectNamespace: event.InvolvedObject.Namespace,
-		InvolvedObjectKind:      event.InvolvedObject.Kind,
-		InvolvedObjectName:      event.InvolvedObject.Name,
-		Reason:                  event.Reason,
-		Message:                 event.Message,
-		Type:                    event.Type,
-		EventTime:               event.LastTimestamp,
-		Action:                  event.Action,
+// NewEventDocument 将事件转换为 es 文档。EventTime 与早期版本保持一致，为 LastTimestamp，
+// 事件的 eventTime 保存在 MicroEventTime
+func NewEventDocument(se *sink.Event) *EventDocument {
+	event := se.Event
+	doc := &EventDocument{
+		Name:                     event.Name,
+		Kind:                     event.Kind,
+		Count:                    int64(event.Count),
+		InvolvedObjectNamespace:  event.InvolvedObject.Namespace,
+		InvolvedObjectKind:       event.InvolvedObject.Kind,
+		InvolvedObjectName:       event.InvolvedObject.Name,
+		InvolvedObjectUID:        string(event.InvolvedObject.UID),
+		InvolvedObjectAPIVersion: event.InvolvedObject.APIVersion,
+		InvolvedObjectFieldPath:  event.InvolvedObject.FieldPath,
+		Reason:                   event.Reason,
+		Message:                  event.Message,
+		Type:                     event.Type,
+		Action:                   event.Action,
+		SourceComponent:          event.Source.Component,
+		SourceHost:               event.Source.Host,
+		ReportingController:      event.ReportingController,
+		ReportingInstance:        event.ReportingInstance,
+		FirstTimestamp:           event.FirstTimestamp,
+		LastTimestamp:            event.LastTimestamp,
+		EventTime:                event.LastTimestamp,
+		MicroEventTime:           v1.NewTime(event.EventTime.Time),
+		Labels:                   event.Labels,
+		Timestamp:                v1.NewTime(EventTimestamp(event)),
+	}
+	if event.Related != nil {
+		doc.RelatedName = event.Related.Name
+		doc.RelatedKind = event.Related.Kind
+		doc.RelatedNamespace = event.Related.Namespace
+	}
+	if event.Series != nil {
+		doc.SeriesCount = int64(event.Series.Count)
+		doc.SeriesLastObservedTime = v1.NewTime(event.Series.LastObservedTime.Time)
+	}
+	if e := se.Enrichment; e != nil {
+		doc.ObjectLabels = e.Labels
+		doc.ObjectAnnotations = e.Annotations
+		for _, owner := range e.Owners {
+			doc.OwnerChain = append(doc.OwnerChain, owner.String())
+		}
+		doc.WorkloadKind = e.Workload.Kind
+		doc.WorkloadName = e.Workload.Name
+		doc.NodeName = e.NodeName
+		doc.ContainerImages = e.Images
 	}
+	return doc
+}
+
+// jsonBody 将请求体编码为 JSON，请求体都是内部构造的 map，不会编码失败
+func jsonBody(body map[string]interface{}) io.Reader {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		klog.Errorf("error encoding request body: %s", err)
+	}
+	return &buf
+}
+
+// DocumentID 根据写入模式生成文档 ID：latest 模式下同一事件始终对应一个文档，
+// history 模式下事件每发生一次（count 变化）对应一个文档
+func DocumentID(event *v1api.Event, mode string) string {
+	if event.UID == "" {
+		return ""
+	}
+	if mode == DocumentModeHistory {
+		count := event.Count
+		// events.k8s.io 记录的事件 count 为 0，重复发生时递增的是 series.count
+		if event.Series != nil {
+			count = event.Series.Count
+		}
+		return fmt.Sprintf("%s-%d", event.UID, count)
+	}
+	return string(event.UID)
+}
+
+func (c *ESClient) SyncEventItem(event *sink.Event, indexName, documentID, opType string) error {
 	// 将 EventDocument 转换为 JSON 字节
-	eventBytes, err := json.Marshal(eventDoc)
+	eventBytes, err := json.Marshal(NewEventDocument(event))
 	if err != nil {
-		klog.Fatalf("Error marshaling event: %s", err)
+		return sink.Permanent(fmt.Errorf("error marshaling event: %s", err))
 	}
 
 	req := esapi.IndexRequest{
-		Index: indexName,
-		Body:  strings.NewReader(string(eventBytes)),
+		Index:      indexName,
+		DocumentID: documentID,
+		OpType:     opType,
+		Body:       strings.NewReader(string(eventBytes)),
 	}
 
 	// 执行索引请求
-	res, err := req.Do(context.Background(), c.Client)
+	res, err := req.Do(context.Background(), c.transport)
 	if err != nil {
-		klog.Fatalf("Error indexing document: %s", err)
+		return fmt.Errorf("error indexing document: %s", err)
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		klog.Fatalf("Error indexing document: %s", res.String())
+		// op_type=create 时文档已存在，说明该事件已经写入过
+		if opType == OpTypeCreate && res.StatusCode == http.StatusConflict {
+			return nil
+		}
+		err := fmt.Errorf("error indexing document: %s", res.String())
+		if !isRetryableStatus(res.StatusCode) {
+			return sink.Permanent(err)
+		}
+		return err
 	}
+	return nil
 }
 
-func (c *ESClient) SearchEventDocuments(namespace, kind, name string) ([]*EventDocument, int64, error) {
-	var buf bytes.Buffer
-	var r map[string]interface{}
-	// 创建查询条件
-	query := map[string]interface{}{
-		"query": map[string]interface{}{
-			"bool": map[string]interface{}{
-				"must": []map[string]interface{}{
-					{
-						"match": map[string]interface{}{
-							"InvolvedObjectNamespace": namespace,
-						},
-					},
-					{
-						"match": map[string]interface{}{
-							"InvolvedObjectKind": kind,
-						},
-					},
-					{
-						"match": map[string]interface{}{
-							"InvolvedObjectName": name,
-						},
-					},
-				},
-			},
-		},
+// InitLifecyclePolicy 创建或更新索引生命周期策略，es 使用 ILM，OpenSearch 使用 ISM
+func (c *ESClient) InitLifecyclePolicy() error {
+	info, err := c.Server(context.Background())
+	if err != nil {
+		return err
 	}
-
-	if err := json.NewEncoder(&buf).Encode(query); err != nil {
-		return nil, 0, fmt.Errorf("error encoding query: %s", err)
+	if info.IsOpenSearch() {
+		return c.InitISMPolicy()
 	}
+	return c.InitIndexILMPolicy()
+}
 
-	// Perform the search request
-	res, err := c.Client.Search(
-		c.Client.Search.WithContext(context.Background()),
-		c.Client.Search.WithIndex("k8s-event-collector-*"),
-		c.Client.Search.WithBody(&buf),
-		c.Client.Search.WithTrackTotalHits(true),
-		c.Client.Search.WithPretty(),
-	)
+// InitTemplates 创建或更新索引模板，es 7.8 以前只支持 legacy template
+func (c *ESClient) InitTemplates() error {
+	info, err := c.Server(context.Background())
 	if err != nil {
-		return nil, 0, fmt.Errorf("error getting response: %s", err)
-	}
-	defer res.Body.Close()
-
-	if res.IsError() {
-		var e map[string]interface{}
-		if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
-			return nil, 0, fmt.Errorf("error parsing the response body: %s", err)
-		} else {
-			// Print the response status and error information.
-			return nil, 0, fmt.Errorf("[%s] %s: %s",
-				res.Status(),
-				e["error"].(map[string]interface{})["type"],
-				e["error"].(map[string]interface{})["reason"],
-			)
-		}
+		return err
 	}
-
-	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-		return nil, 0, fmt.Errorf("error parsing the response body: %s", err)
+	if c.cfg.Index.DataStream && !info.SupportsDataStream() {
+		return fmt.Errorf("data stream is not supported by %s", info)
 	}
-
-	klog.Infof(
-		"[%s] %d hits; took: %dms",
-		res.Status(),
-		int(r["hits"].(map[string]interface{})["total"].(map[string]interface{})["value"].(float64)),
-		int(r["took"].(float64)),
-	)
-
-	var events []*EventDocument
-	for _, hit := range r["hits"].(map[string]interface{})["hits"].([]interface{}) {
-		klog.Infof(" * ID=%s, %s", hit.(map[string]interface{})["_id"], hit.(map[string]interface{})["_source"])
-		source := hit.(map[string]interface{})["_source"].(map[string]interface{})
-		klog.Infof("source: %v", source)
-		event := &EventDocument{
-			Type:                    source["Type"].(string),
-			Message:                 source["Message"].(string),
-			Reason:                  source["Reason"].(string),
-			Action:                  source["Action"].(string),
-			Name:                    source["Name"].(string),
-			Kind:                    source["Kind"].(string),
-			RelatedName:             source["RelatedName"].(string),
-			RelatedKind:             source["RelatedKind"].(string),
-			RelatedNamespace:        source["RelatedNamespace"].(string),
-			InvolvedObjectNamespace: source["InvolvedObjectNamespace"].(string),
-			InvolvedObjectKind:      source["InvolvedObjectKind"].(string),
-			InvolvedObjectName:      source["InvolvedObjectName"].(string),
-			Count:                   int64(source["Count"].(float64)),
-		}
-		eventTime, err := time.Parse(time.RFC3339, source["EventTime"].(string))
-		if err != nil {
-			klog.Errorf("Error parsing EventTime:", err)
-
-		}
-		event.EventTime = v1.NewTime(eventTime)
-		events = append(events, event)
+	if info.SupportsComposableTemplate() {
+		return c.InitComposableIndexTemplate(!info.IsOpenSearch())
 	}
-	totalHits := int64(r["hits"].(map[string]interface{})["total"].(map[string]interface{})["value"].(float64))
-
-	return events, totalHits, nil
+	return c.InitIndexTemplate()
 }
 
-func InitIndexTemplate(client *elasticsearch.Client) {
-	indexTemplateName := "k8s-event-collector"
+func (c *ESClient) InitIndexTemplate() error {
+	indexTemplateName := c.cfg.Index.templateName()
 	req := esapi.IndicesPutTemplateRequest{
 		Name: indexTemplateName,
-		Body: strings.NewReader(CreateEventDocumentIndexTemplateBod),
+		Body: jsonBody(c.cfg.Index.IndexTemplateBody()),
 	}
 
 	// Perform the request
-	res, err := req.Do(context.Background(), client)
+	res, err := req.Do(context.Background(), c.transport)
 	if err != nil {
-		klog.Fatalf("failed to create index template: %v", err)
+		return fmt.Errorf("failed to create index template: %v", err)
 	}
 	defer res.Body.Close()
 
 	// Check the response status
 	if res.IsError() {
-		klog.Fatalf("failed to create index template: %s", res.String())
+		return fmt.Errorf("failed to create index template: %s", res.String())
 	}
 
 	klog.Infof("Index template created: %s", indexTemplateName)
+	return nil
 }
 
-func InitIndexILMPolicy(client *elasticsearch.Client) {
+func (c *ESClient) InitIndexILMPolicy() error {
 	createILMPolicyReq := esapi.ILMPutLifecycleRequest{
-		Policy: IndexILMName,
-		Body:   strings.NewReader(CreateIndexILMPolicyBody),
+		Policy: c.cfg.Index.ILMPolicyName,
+		Body:   jsonBody(c.cfg.Index.ILMPolicyBody()),
 	}
 
-	createILMPolicyRes, err := createILMPolicyReq.Do(context.Background(), client)
+	createILMPolicyRes, err := createILMPolicyReq.Do(context.Background(), c.transport)
 	if err != nil {
-		klog.Fatalf("Error creating index lifecycle policy: %s", err)
+		return fmt.Errorf("error creating index lifecycle policy: %s", err)
 	}
 	defer createILMPolicyRes.Body.Close()
 
 	if createILMPolicyRes.IsError() {
-		klog.Fatalf("Error creating index lifecycle policy: %s", createILMPolicyRes.String())
+		return fmt.Errorf("error creating index lifecycle policy: %s", createILMPolicyRes.String())
 	}
 
 	klog.Info("Index lifecycle policy created successfully.")
+	return nil
+}
+
+func (c *ESClient) InitComposableIndexTemplate(ilm bool) error {
+	templateName := c.cfg.Index.templateName()
+	req := esapi.IndicesPutIndexTemplateRequest{
+		Name: templateName,
+		Body: jsonBody(c.cfg.Index.ComposableTemplateBody(ilm)),
+	}
+
+	res, err := req.Do(context.Background(), c.transport)
+	if err != nil {
+		return fmt.Errorf("failed to create composable index template: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("failed to create composable index template: %s", res.String())
+	}
+
+	klog.Infof("Composable index template created: %s", templateName)
+	return nil
+}
+
+func (c *ESClient) CreateDataStream(name string) error {
+	req := esapi.IndicesCreateDataStreamRequest{
+		Name: name,
+	}
+	res, err := req.Do(context.Background(), c.transport)
+	if err != nil {
+		return fmt.Errorf("error creating the data stream: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		if strings.Contains(res.String(), "resource_already_exists_exception") {
+			klog.Infof("Data stream %s already exists, skipping creation", name)
+			return nil
+		}
+		return fmt.Errorf("error creating the data stream: %s", res.String())
+	}
+	klog.Infof("data stream %s Create successfully", name)
+	return nil
 }
 
 /*
@@ -0,0 +1,37 @@
+package elasticsearch
+
+import (
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestDocumentID(t *testing.T) {
+	tests := []struct {
+		name     string
+		count    int32
+		series   *v1api.EventSeries
+		mode     string
+		expected string
+	}{
+		{name: "latest", count: 3, mode: DocumentModeLatest, expected: "event-uid"},
+		{name: "history", count: 3, mode: DocumentModeHistory, expected: "event-uid-3"},
+		{name: "history series", series: &v1api.EventSeries{Count: 4}, mode: DocumentModeHistory, expected: "event-uid-4"},
+		{name: "latest series", series: &v1api.EventSeries{Count: 4}, mode: DocumentModeLatest, expected: "event-uid"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := &v1api.Event{
+				ObjectMeta: metav1.ObjectMeta{UID: "event-uid"},
+				Count:      test.count,
+				Series:     test.series,
+			}
+			if got := DocumentID(event, test.mode); got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+	if got := DocumentID(&v1api.Event{}, DocumentModeHistory); got != "" {
+		t.Errorf("expected empty id for event without uid, got %q", got)
+	}
+}
@@ -1,77 +1,449 @@
 package elasticsearch
 
-import v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+import (
+	"fmt"
+	v1api "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type EventDocument struct {
-	Type                    string
-	Message                 string
-	Reason                  string
-	Action                  string
-	Name                    string
-	Kind                    string
-	RelatedName             string
-	RelatedKind             string
-	RelatedNamespace        string
-	InvolvedObjectNamespace string
-	InvolvedObjectKind      string
-	InvolvedObjectName      string
-	EventTime               v1.Time
-	Count                   int64
-}
-
-const IndexILMName = "K8sEventCollectorILM"
-
-const CreateEventDocumentIndexTemplateBod string = `
-{
-  "index_patterns": ["k8s-event-collector*"],
-  "mappings": {
-    "properties": {
-      "Type": { "type": "keyword" },
-      "Message": { "type": "text" },
-      "Reason": { "type": "keyword" },
-      "Action": { "type": "keyword" },
-      "Name": { "type": "keyword" },
-      "Kind": { "type": "keyword" },
-      "RelatedName": { "type": "keyword" },
-      "RelatedKind": { "type": "keyword" },
-      "RelatedNamespace": { "type": "keyword" },
-      "InvolvedObjectNamespace": { "type": "keyword" },
-      "InvolvedObjectKind": { "type": "keyword" },
-      "InvolvedObjectName": { "type": "keyword" },
-      "EventTime": { "type": "date" },
-      "Count": { "type": "long" }
-    }
-  }
-}
-`
-
-const CreateIndexEventDocumentBody string = `
-{
-	"settings": {
-		"index.lifecycle.name": "%s",
-		"index.lifecycle.rollover_alias": "%s"
-	}
-}
-`
-
-const CreateIndexILMPolicyBody string = `
-		{
-			"policy": {
-				"phases": {
-					"hot": {
-						"actions": {
-							"rollover": {
-								"max_age": "1d"
-							}
-						}
-					},
-					"delete": {
-						"min_age": "3d",
-						"actions": {
-							"delete": {}
-						}
-					}
-				}
+	Type                     string
+	Message                  string
+	Reason                   string
+	Action                   string
+	Name                     string
+	Kind                     string
+	RelatedName              string
+	RelatedKind              string
+	RelatedNamespace         string
+	InvolvedObjectNamespace  string
+	InvolvedObjectKind       string
+	InvolvedObjectName       string
+	InvolvedObjectUID        string
+	InvolvedObjectAPIVersion string
+	InvolvedObjectFieldPath  string
+	SourceComponent          string
+	SourceHost               string
+	ReportingController      string
+	ReportingInstance        string
+	FirstTimestamp           v1.Time
+	LastTimestamp            v1.Time
+	EventTime                v1.Time
+	MicroEventTime           v1.Time
+	Count                    int64
+	SeriesCount              int64
+	SeriesLastObservedTime   v1.Time
+	Labels                   map[string]string `json:",omitempty"`
+	// 涉及对象的元数据，开启 enrich 时填充
+	ObjectLabels      map[string]string `json:",omitempty"`
+	ObjectAnnotations map[string]string `json:",omitempty"`
+	OwnerChain        []string          `json:",omitempty"`
+	WorkloadKind      string            `json:",omitempty"`
+	WorkloadName      string            `json:",omitempty"`
+	NodeName          string            `json:",omitempty"`
+	ContainerImages   []string          `json:",omitempty"`
+	// data stream 要求每个文档都有 @timestamp 字段
+	Timestamp v1.Time `json:"@timestamp"`
+}
+
+const (
+	DefaultIndexPrefix   = "k8s-event-collector"
+	DefaultILMPolicyName = "K8sEventCollectorILM"
+)
+
+// IndexConfig 描述索引命名、模板和 ILM 策略
+type IndexConfig struct {
+	// 索引、data stream 和模板名称的前缀，多个集群写入同一个 es 时用于区分
+	Prefix string `yaml:"prefix"`
+	// 写入和查询 data stream，而不是按天创建的索引
+	DataStream bool `yaml:"dataStream"`
+	// 为 0 或负数时使用 es 的默认值
+	Shards   int `yaml:"shards"`
+	Replicas int `yaml:"replicas"`
+
+	ILMPolicyName string `yaml:"ilmPolicyName"`
+	// rollover 条件，仅 data stream 使用，按天创建的索引不需要 rollover
+	RolloverMaxAge  string `yaml:"rolloverMaxAge"`
+	RolloverMaxSize string `yaml:"rolloverMaxSize"`
+	RolloverMaxDocs int64  `yaml:"rolloverMaxDocs"`
+	// 各阶段的 min_age，为空时不启用该阶段
+	WarmAfter   string `yaml:"warmAfter"`
+	ColdAfter   string `yaml:"coldAfter"`
+	DeleteAfter string `yaml:"deleteAfter"`
+
+	// 模板和 ILM 策略由运维维护时关闭
+	ManageTemplate bool `yaml:"manageTemplate"`
+	ManageILM      bool `yaml:"manageILM"`
+}
+
+func DefaultIndexConfig() IndexConfig {
+	return IndexConfig{
+		Prefix:         DefaultIndexPrefix,
+		Replicas:       -1,
+		ILMPolicyName:  DefaultILMPolicyName,
+		RolloverMaxAge: "1d",
+		DeleteAfter:    "3d",
+		ManageTemplate: true,
+		ManageILM:      true,
+	}
+}
+
+// IndexNameFor 返回 t 所在日期（UTC）的索引名
+func (c *IndexConfig) IndexNameFor(t time.Time) string {
+	return fmt.Sprintf("%s-%s", c.Prefix, t.UTC().Format("2006-01-02"))
+}
+
+// DataStreamName 返回写入的 data stream 名称
+func (c *IndexConfig) DataStreamName() string {
+	return c.Prefix
+}
+
+// SearchIndex 返回查询事件时使用的索引
+func (c *IndexConfig) SearchIndex() string {
+	if c.DataStream {
+		return c.DataStreamName()
+	}
+	return c.Prefix + "-*"
+}
+
+func (c *IndexConfig) templateName() string {
+	if c.DataStream {
+		return c.Prefix + "-data-stream"
+	}
+	return c.Prefix
+}
+
+// settings 返回索引配置，OpenSearch 使用 ISM 的 ism_template 关联策略，不设置 ilm
+func (c *IndexConfig) settings(ilm bool) map[string]interface{} {
+	settings := map[string]interface{}{}
+	if c.Shards > 0 {
+		settings["index.number_of_shards"] = c.Shards
+	}
+	if c.Replicas >= 0 {
+		settings["index.number_of_replicas"] = c.Replicas
+	}
+	if ilm && c.ILMPolicyName != "" {
+		settings["index.lifecycle.name"] = c.ILMPolicyName
+	}
+	return settings
+}
+
+// eventDocumentMappings 是 EventDocument 的索引 mapping，标签和注解下的字段动态映射为 keyword
+func eventDocumentMappings() map[string]interface{} {
+	keyword := map[string]interface{}{"type": "keyword"}
+	date := map[string]interface{}{"type": "date"}
+	long := map[string]interface{}{"type": "long"}
+	return map[string]interface{}{
+		"dynamic_templates": []map[string]interface{}{
+			{
+				"labels": map[string]interface{}{
+					"path_match":         "Labels.*",
+					"match_mapping_type": "string",
+					"mapping":            keyword,
+				},
+			},
+			{
+				"object_labels": map[string]interface{}{
+					"path_match":         "ObjectLabels.*",
+					"match_mapping_type": "string",
+					"mapping":            keyword,
+				},
+			},
+			{
+				"object_annotations": map[string]interface{}{
+					"path_match":         "ObjectAnnotations.*",
+					"match_mapping_type": "string",
+					"mapping":            keyword,
+				},
+			},
+		},
+		"properties": map[string]interface{}{
+			"Type":                     keyword,
+			"Message":                  map[string]interface{}{"type": "text"},
+			"Reason":                   keyword,
+			"Action":                   keyword,
+			"Name":                     keyword,
+			"Kind":                     keyword,
+			"RelatedName":              keyword,
+			"RelatedKind":              keyword,
+			"RelatedNamespace":         keyword,
+			"InvolvedObjectNamespace":  keyword,
+			"InvolvedObjectKind":       keyword,
+			"InvolvedObjectName":       keyword,
+			"InvolvedObjectUID":        keyword,
+			"InvolvedObjectAPIVersion": keyword,
+			"InvolvedObjectFieldPath":  keyword,
+			"SourceComponent":          keyword,
+			"SourceHost":               keyword,
+			"ReportingController":      keyword,
+			"ReportingInstance":        keyword,
+			"FirstTimestamp":           date,
+			"LastTimestamp":            date,
+			"EventTime":                date,
+			"MicroEventTime":           date,
+			"Count":                    long,
+			"SeriesCount":              long,
+			"SeriesLastObservedTime":   date,
+			"Labels":                   map[string]interface{}{"type": "object"},
+			"ObjectLabels":             map[string]interface{}{"type": "object"},
+			"ObjectAnnotations":        map[string]interface{}{"type": "object"},
+			"OwnerChain":               keyword,
+			"WorkloadKind":             keyword,
+			"WorkloadName":             keyword,
+			"NodeName":                 keyword,
+			"ContainerImages":          keyword,
+			"@timestamp":               date,
+		},
+	}
+}
+
+// IndexTemplateBody 返回 es 7.8 以前按天索引使用的 legacy template
+func (c *IndexConfig) IndexTemplateBody() map[string]interface{} {
+	return map[string]interface{}{
+		"index_patterns": []string{c.Prefix + "-*"},
+		"settings":       c.settings(true),
+		"mappings":       eventDocumentMappings(),
+	}
+}
+
+// ComposableTemplateBody 返回 composable index template，data stream 的模板
+// 优先级高于按天索引的模板
+func (c *IndexConfig) ComposableTemplateBody(ilm bool) map[string]interface{} {
+	body := map[string]interface{}{
+		"index_patterns": []string{c.Prefix + "-*"},
+		"priority":       100,
+		"template": map[string]interface{}{
+			"settings": c.settings(ilm),
+			"mappings": eventDocumentMappings(),
+		},
+	}
+	if c.DataStream {
+		body["index_patterns"] = []string{c.DataStreamName()}
+		body["data_stream"] = map[string]interface{}{}
+		body["priority"] = 200
+	}
+	return body
+}
+
+// CreateIndexBody 返回创建按天索引时的请求体
+func (c *IndexConfig) CreateIndexBody(ilm bool) map[string]interface{} {
+	return map[string]interface{}{
+		"settings": c.settings(ilm),
+	}
+}
+
+// ILMPolicyBody 返回 ILM 策略。按天创建的索引不使用 rollover，
+// data stream 的 backing index 通过 rollover 滚动
+func (c *IndexConfig) ILMPolicyBody() map[string]interface{} {
+	hotActions := map[string]interface{}{}
+	if c.DataStream {
+		if rollover := c.rolloverConditions(false); len(rollover) > 0 {
+			hotActions["rollover"] = rollover
+		}
+	}
+
+	phases := map[string]interface{}{
+		"hot": map[string]interface{}{
+			"actions": hotActions,
+		},
+	}
+	if c.WarmAfter != "" {
+		phases["warm"] = map[string]interface{}{
+			"min_age": c.WarmAfter,
+			"actions": map[string]interface{}{
+				"set_priority": map[string]interface{}{"priority": 50},
+			},
+		}
+	}
+	if c.ColdAfter != "" {
+		phases["cold"] = map[string]interface{}{
+			"min_age": c.ColdAfter,
+			"actions": map[string]interface{}{
+				"set_priority": map[string]interface{}{"priority": 0},
+			},
+		}
+	}
+	if c.DeleteAfter != "" {
+		phases["delete"] = map[string]interface{}{
+			"min_age": c.DeleteAfter,
+			"actions": map[string]interface{}{
+				"delete": map[string]interface{}{},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"policy": map[string]interface{}{
+			"phases": phases,
+		},
+	}
+}
+
+// bulk/index 请求的 op_type
+const (
+	OpTypeIndex  = "index"
+	OpTypeCreate = "create"
+)
+
+// 文档写入模式
+const (
+	// DocumentModeLatest 每个事件只保留最新状态，count 变化时覆盖原文档
+	DocumentModeLatest = "latest"
+	// DocumentModeHistory 事件每发生一次都追加一个文档
+	DocumentModeHistory = "history"
+)
+
+// 首次发生的索引在该时间内会被删除时，latest 模式改为写入本次发生的索引
+const indexRetentionMargin = 24 * time.Hour
+
+// IndexTime 返回决定事件写入哪个索引的时间。latest 模式使用事件首次发生的时间，
+// 保证同一事件的更新覆盖同一个索引中的文档；持续发生的事件在首次发生的索引快要被 ILM 删除时
+// 改用本次发生的时间，避免写入已经删除的索引，旧索引删除前两个索引中都有该事件。
+// history 模式使用本次发生的时间
+func (c *IndexConfig) IndexTime(event *v1api.Event, mode string) time.Time {
+	if mode != DocumentModeLatest {
+		return EventTimestamp(event)
+	}
+	first := firstNonZero(event.FirstTimestamp.Time, event.EventTime.Time, event.LastTimestamp.Time, event.CreationTimestamp.Time)
+	retention, err := parseTimeValue(c.DeleteAfter)
+	if err != nil || retention <= 0 {
+		return first
+	}
+	// 索引最早在当天开始时创建，按当天开始时间计算索引的年龄
+	created := first.UTC().Truncate(24 * time.Hour)
+	if time.Since(created) >= retention-indexRetentionMargin {
+		return EventTimestamp(event)
+	}
+	return first
+}
+
+// parseTimeValue 解析 es 的时间值，例如 3d、12h、30m
+func parseTimeValue(value string) (time.Duration, error) {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"ms", time.Millisecond},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(value, u.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSuffix(value, u.suffix), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid time value %q", value)
 			}
+			return time.Duration(n) * u.unit, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time value %q", value)
+}
+
+// EventTimestamp 返回事件本次发生的时间，用作文档的 @timestamp。
+// events.k8s.io 记录的事件重复发生时只更新 series.lastObservedTime
+func EventTimestamp(event *v1api.Event) time.Time {
+	if event.Series != nil && !event.Series.LastObservedTime.IsZero() {
+		return event.Series.LastObservedTime.Time
+	}
+	return firstNonZero(event.LastTimestamp.Time, event.EventTime.Time, event.FirstTimestamp.Time, event.CreationTimestamp.Time)
+}
+
+func firstNonZero(candidates ...time.Time) time.Time {
+	for _, t := range candidates {
+		if !t.IsZero() {
+			return t
 		}
-`
+	}
+	return time.Now()
+}
+
+// rolloverConditions 返回 rollover 条件，ilm 与 ism 的条件名称不同
+func (c *IndexConfig) rolloverConditions(ism bool) map[string]interface{} {
+	names := []string{"max_age", "max_primary_shard_size", "max_docs"}
+	if ism {
+		names = []string{"min_index_age", "min_primary_shard_size", "min_doc_count"}
+	}
+	rollover := map[string]interface{}{}
+	if c.RolloverMaxAge != "" {
+		rollover[names[0]] = c.RolloverMaxAge
+	}
+	if c.RolloverMaxSize != "" {
+		rollover[names[1]] = c.RolloverMaxSize
+	}
+	if c.RolloverMaxDocs > 0 {
+		rollover[names[2]] = c.RolloverMaxDocs
+	}
+	return rollover
+}
+
+// ISMPolicyBody 返回 OpenSearch 的 ISM 策略，与 ILMPolicyBody 的阶段一一对应，
+// 通过 ism_template 自动关联新创建的索引
+func (c *IndexConfig) ISMPolicyBody() map[string]interface{} {
+	type phase struct {
+		name    string
+		after   string
+		actions []interface{}
+	}
+	hotActions := []interface{}{}
+	if c.DataStream {
+		if rollover := c.rolloverConditions(true); len(rollover) > 0 {
+			hotActions = append(hotActions, map[string]interface{}{"rollover": rollover})
+		}
+	}
+	phases := []phase{{name: "hot", actions: hotActions}}
+	if c.WarmAfter != "" {
+		phases = append(phases, phase{name: "warm", after: c.WarmAfter, actions: []interface{}{
+			map[string]interface{}{"index_priority": map[string]interface{}{"priority": 50}},
+		}})
+	}
+	if c.ColdAfter != "" {
+		phases = append(phases, phase{name: "cold", after: c.ColdAfter, actions: []interface{}{
+			map[string]interface{}{"index_priority": map[string]interface{}{"priority": 0}},
+		}})
+	}
+	if c.DeleteAfter != "" {
+		phases = append(phases, phase{name: "delete", after: c.DeleteAfter, actions: []interface{}{
+			map[string]interface{}{"delete": map[string]interface{}{}},
+		}})
+	}
+
+	states := make([]interface{}, 0, len(phases))
+	for i, p := range phases {
+		transitions := []interface{}{}
+		if i+1 < len(phases) {
+			next := phases[i+1]
+			transitions = append(transitions, map[string]interface{}{
+				"state_name": next.name,
+				"conditions": map[string]interface{}{"min_index_age": next.after},
+			})
+		}
+		states = append(states, map[string]interface{}{
+			"name":        p.name,
+			"actions":     p.actions,
+			"transitions": transitions,
+		})
+	}
+
+	// data stream 的 backing index 以 .ds- 开头
+	pattern := c.Prefix + "-*"
+	if c.DataStream {
+		pattern = ".ds-" + c.DataStreamName() + "-*"
+	}
+	return map[string]interface{}{
+		"policy": map[string]interface{}{
+			"description":   "lifecycle of kubernetes events written by k8s-event-collector",
+			"default_state": "hot",
+			"states":        states,
+			"ism_template": []interface{}{
+				map[string]interface{}{
+					"index_patterns": []string{pattern},
+					"priority":       100,
+				},
+			},
+		},
+	}
+}
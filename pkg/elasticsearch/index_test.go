@@ -0,0 +1,57 @@
+package elasticsearch
+
+import (
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestIndexTime(t *testing.T) {
+	now := time.Now()
+	recent := metav1.NewTime(now.Add(-time.Hour))
+	tests := []struct {
+		name        string
+		first       time.Time
+		mode        string
+		deleteAfter string
+		expected    time.Time
+	}{
+		{name: "history uses last timestamp", first: now.Add(-48 * time.Hour), mode: DocumentModeHistory, deleteAfter: "3d", expected: recent.Time},
+		{name: "latest uses first timestamp", first: now.Add(-2 * time.Hour), mode: DocumentModeLatest, deleteAfter: "3d", expected: now.Add(-2 * time.Hour)},
+		{name: "latest keeps first timestamp without retention", first: now.Add(-240 * time.Hour), mode: DocumentModeLatest, expected: now.Add(-240 * time.Hour)},
+		// 首次发生的索引快要被删除，改为写入本次发生的索引
+		{name: "latest moves before the index is deleted", first: now.Add(-72 * time.Hour), mode: DocumentModeLatest, deleteAfter: "3d", expected: recent.Time},
+		{name: "latest moves for short retention", first: now.Add(-2 * time.Hour), mode: DocumentModeLatest, deleteAfter: "12h", expected: recent.Time},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := &v1api.Event{FirstTimestamp: metav1.NewTime(test.first), LastTimestamp: recent}
+			cfg := DefaultIndexConfig()
+			cfg.DeleteAfter = test.deleteAfter
+			if got := cfg.IndexTime(event, test.mode); !got.Equal(test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseTimeValue(t *testing.T) {
+	tests := map[string]time.Duration{
+		"3d":    72 * time.Hour,
+		"12h":   12 * time.Hour,
+		"30m":   30 * time.Minute,
+		"45s":   45 * time.Second,
+		"500ms": 500 * time.Millisecond,
+	}
+	for value, expected := range tests {
+		if got, err := parseTimeValue(value); err != nil || got != expected {
+			t.Errorf("%s: expected %v, got %v, %v", value, expected, got, err)
+		}
+	}
+	for _, value := range []string{"", "3", "3w", "d"} {
+		if _, err := parseTimeValue(value); err == nil {
+			t.Errorf("expected %q to be invalid", value)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"k8s.io/klog/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const ismPolicyPath = "/_plugins/_ism/policies/"
+
+// InitISMPolicy 创建或更新 OpenSearch 的 ISM 策略。策略已存在时更新需要带上
+// 当前的 seq_no 和 primary_term，否则 OpenSearch 返回 409
+func (c *ESClient) InitISMPolicy() error {
+	ctx := context.Background()
+	policyPath := ismPolicyPath + url.PathEscape(c.cfg.Index.ILMPolicyName)
+
+	query := url.Values{}
+	seqNo, primaryTerm, exists, err := c.getISMPolicyVersion(ctx, policyPath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		query.Set("if_seq_no", strconv.FormatInt(seqNo, 10))
+		query.Set("if_primary_term", strconv.FormatInt(primaryTerm, 10))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, policyPath, jsonBody(c.cfg.Index.ISMPolicyBody()))
+	if err != nil {
+		return err
+	}
+	req.URL.RawQuery = query.Encode()
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.transport.Perform(req)
+	if err != nil {
+		return fmt.Errorf("error creating index state management policy: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("error creating index state management policy: [%d] %s", res.StatusCode, readErrorBody(res))
+	}
+
+	klog.Info("Index state management policy created successfully.")
+	return nil
+}
+
+func (c *ESClient) getISMPolicyVersion(ctx context.Context, policyPath string) (int64, int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, policyPath, nil)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	res, err := c.transport.Perform(req)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("error getting index state management policy: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return 0, 0, false, nil
+	}
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return 0, 0, false, fmt.Errorf("error getting index state management policy: [%d] %s", res.StatusCode, readErrorBody(res))
+	}
+
+	var r struct {
+		SeqNo       int64 `json:"_seq_no"`
+		PrimaryTerm int64 `json:"_primary_term"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return 0, 0, false, fmt.Errorf("error parsing the policy response body: %s", err)
+	}
+	return r.SeqNo, r.PrimaryTerm, true, nil
+}
+
+func readErrorBody(res *http.Response) string {
+	var e map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("%v", e["error"])
+}
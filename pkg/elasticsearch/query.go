@@ -0,0 +1,174 @@
+package elasticsearch
+
+import (
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
+	"strings"
+)
+
+// LabelOperator 是标签匹配的方式
+type LabelOperator int
+
+const (
+	LabelEqual LabelOperator = iota
+	LabelNotEqual
+	LabelExists
+	LabelNotExists
+)
+
+// LabelMatcher 匹配 enrich 时记录的对象标签
+type LabelMatcher struct {
+	Key      string
+	Value    string
+	Operator LabelOperator
+}
+
+// EventFilter 是事件的过滤条件，空值表示不限制。
+// 同一字段的多个值之间是或的关系，不同字段之间是与的关系
+type EventFilter struct {
+	Namespaces []string
+	Kinds      []string
+	Names      []string
+	Type       string
+	Reasons    []string
+	// 匹配 enrich 记录的节点或事件来源的主机
+	Node string
+	// 匹配 source.component 或 reportingController
+	Component string
+	// 对 Message 全文检索，支持 simple_query_string 语法
+	Message string
+	Labels  []LabelMatcher
+}
+
+// clauses 将过滤条件转换为 bool 查询的 filter 和 must_not 子句
+func (f *EventFilter) clauses() (filter, mustNot []map[string]interface{}) {
+	terms := func(field string, values []string) {
+		if len(values) > 0 {
+			filter = append(filter, map[string]interface{}{"terms": map[string]interface{}{field: values}})
+		}
+	}
+	terms("InvolvedObjectNamespace", f.Namespaces)
+	terms("InvolvedObjectKind", f.Kinds)
+	terms("InvolvedObjectName", f.Names)
+	terms("Reason", f.Reasons)
+	if f.Type != "" {
+		filter = append(filter, term("Type", f.Type))
+	}
+	if f.Node != "" {
+		filter = append(filter, anyOf(term("NodeName", f.Node), term("SourceHost", f.Node)))
+	}
+	if f.Component != "" {
+		filter = append(filter, anyOf(term("SourceComponent", f.Component), term("ReportingController", f.Component)))
+	}
+	if f.Message != "" {
+		filter = append(filter, map[string]interface{}{
+			"simple_query_string": map[string]interface{}{
+				"query":            f.Message,
+				"fields":           []string{"Message"},
+				"default_operator": "and",
+			},
+		})
+	}
+
+	for _, l := range f.Labels {
+		field := "ObjectLabels." + l.Key
+		switch l.Operator {
+		case LabelEqual:
+			filter = append(filter, term(field, l.Value))
+		case LabelNotEqual:
+			mustNot = append(mustNot, term(field, l.Value))
+		case LabelExists:
+			filter = append(filter, exists(field))
+		case LabelNotExists:
+			mustNot = append(mustNot, exists(field))
+		}
+	}
+	return filter, mustNot
+}
+
+// Match 在内存中判断事件是否满足过滤条件，用于实时推送。
+// Message 只支持按空白分隔的词（全部包含）和以 - 开头的排除词，不区分大小写
+func (f *EventFilter) Match(event *sink.Event) bool {
+	in := func(values []string, value string) bool {
+		if len(values) == 0 {
+			return true
+		}
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+	ref := event.InvolvedObject
+	if !in(f.Namespaces, ref.Namespace) || !in(f.Kinds, ref.Kind) || !in(f.Names, ref.Name) || !in(f.Reasons, event.Reason) {
+		return false
+	}
+	if f.Type != "" && f.Type != event.Type {
+		return false
+	}
+
+	var nodeName string
+	var labels map[string]string
+	if event.Enrichment != nil {
+		nodeName = event.Enrichment.NodeName
+		labels = event.Enrichment.Labels
+	}
+	if f.Node != "" && f.Node != nodeName && f.Node != event.Source.Host {
+		return false
+	}
+	if f.Component != "" && f.Component != event.Source.Component && f.Component != event.ReportingController {
+		return false
+	}
+
+	if f.Message != "" {
+		message := strings.ToLower(event.Message)
+		for _, word := range strings.Fields(strings.ToLower(f.Message)) {
+			exclude := strings.HasPrefix(word, "-")
+			word = strings.Trim(word, "+-\"")
+			if word != "" && strings.Contains(message, word) == exclude {
+				return false
+			}
+		}
+	}
+
+	for _, l := range f.Labels {
+		value, ok := labels[l.Key]
+		switch l.Operator {
+		case LabelEqual:
+			if !ok || value != l.Value {
+				return false
+			}
+		case LabelNotEqual:
+			if ok && value == l.Value {
+				return false
+			}
+		case LabelExists:
+			if !ok {
+				return false
+			}
+		case LabelNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func term(field, value string) map[string]interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{field: value}}
+}
+
+func exists(field string) map[string]interface{} {
+	return map[string]interface{}{"exists": map[string]interface{}{"field": field}}
+}
+
+// anyOf 匹配任意一个子句
+func anyOf(clauses ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should":               clauses,
+			"minimum_should_match": 1,
+		},
+	}
+}
@@ -0,0 +1,280 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"k8s.io/klog/v2"
+	"sort"
+	"time"
+)
+
+// searchResponse 是 _search 响应中用到的部分
+type searchResponse struct {
+	Took int64 `json:"took"`
+	Hits struct {
+		Total struct {
+			Value int64 `json:"value"`
+		} `json:"total"`
+		Hits []struct {
+			ID     string          `json:"_id"`
+			Source json.RawMessage `json:"_source"`
+			Sort   json.RawMessage `json:"sort"`
+		} `json:"hits"`
+	} `json:"hits"`
+	Aggregations json.RawMessage `json:"aggregations"`
+}
+
+// SearchResult 是一页查询结果，NextPageToken 为空表示没有下一页
+type SearchResult struct {
+	Documents     []*EventDocument
+	Total         int64
+	NextPageToken string
+}
+
+// searchDocuments 执行查询并解析命中的事件文档。size 大于 0 且返回了整页时，
+// 用最后一个文档的 sort 值生成下一页的 token
+func (c *ESClient) searchDocuments(ctx context.Context, query map[string]interface{}) (*SearchResult, error) {
+	r, err := c.search(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// 按结构体解析 _source，旧文档中缺少的字段保持零值
+	result := &SearchResult{Total: r.Hits.Total.Value}
+	for _, hit := range r.Hits.Hits {
+		event := &EventDocument{}
+		if err := json.Unmarshal(hit.Source, event); err != nil {
+			klog.Errorf("Error parsing document %s: %v", hit.ID, err)
+			continue
+		}
+		result.Documents = append(result.Documents, event)
+	}
+	if size, ok := query["size"].(int); ok && size > 0 && len(r.Hits.Hits) == size {
+		result.NextPageToken = base64.RawURLEncoding.EncodeToString(r.Hits.Hits[len(r.Hits.Hits)-1].Sort)
+	}
+	return result, nil
+}
+
+// search 在所有事件索引中执行查询
+func (c *ESClient) search(ctx context.Context, query map[string]interface{}) (*searchResponse, error) {
+	var buf bytes.Buffer
+	var r searchResponse
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		return nil, fmt.Errorf("error encoding query: %s", err)
+	}
+
+	// Perform the search request
+	res, err := c.api.Search(
+		c.api.Search.WithContext(ctx),
+		c.api.Search.WithIndex(c.cfg.Index.SearchIndex()),
+		c.api.Search.WithBody(&buf),
+		c.api.Search.WithTrackTotalHits(true),
+		c.api.Search.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		var e struct {
+			Error struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+			return nil, fmt.Errorf("error parsing the response body: %s", err)
+		}
+		return nil, fmt.Errorf("[%s] %s: %s", res.Status(), e.Error.Type, e.Error.Reason)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("error parsing the response body: %s", err)
+	}
+
+	klog.Infof("[%s] %d hits; took: %dms", res.Status(), r.Hits.Total.Value, r.Took)
+	return &r, nil
+}
+
+// decodePageToken 将 token 还原为 search_after 的值
+func decodePageToken(token string) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page token")
+	}
+	var values []interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	// 保留 long 类型的精度
+	d.UseNumber()
+	if err := d.Decode(&values); err != nil || len(values) == 0 {
+		return nil, fmt.Errorf("invalid page token")
+	}
+	return values, nil
+}
+
+// eventSort 按发生时间排序，同一时间的文档按名称和次数排序，保证 search_after 翻页稳定。
+// 早期版本写入的文档没有 @timestamp，在补齐该字段之前排在最后
+func eventSort(ascending bool) []map[string]interface{} {
+	order := "desc"
+	if ascending {
+		order = "asc"
+	}
+	field := func(unmappedType string) map[string]interface{} {
+		return map[string]interface{}{"order": order, "unmapped_type": unmappedType}
+	}
+	return []map[string]interface{}{
+		{"@timestamp": field("date")},
+		{"InvolvedObjectNamespace": field("keyword")},
+		{"Name": field("keyword")},
+		{"Count": field("long")},
+	}
+}
+
+// EventQuery 是分页查询事件的条件，Since 和 Until 为零值时不限制
+type EventQuery struct {
+	Filter    EventFilter
+	Since     time.Time
+	Until     time.Time
+	PageSize  int
+	PageToken string
+	Ascending bool
+}
+
+// SearchEvents 按条件分页查询事件
+func (c *ESClient) SearchEvents(ctx context.Context, q *EventQuery) (*SearchResult, error) {
+	query := map[string]interface{}{
+		"size":  q.PageSize,
+		"sort":  eventSort(q.Ascending),
+		"query": filterQuery(&q.Filter, q.Since, q.Until),
+	}
+	if q.PageToken != "" {
+		searchAfter, err := decodePageToken(q.PageToken)
+		if err != nil {
+			return nil, err
+		}
+		query["search_after"] = searchAfter
+	}
+	return c.searchDocuments(ctx, query)
+}
+
+// filterQuery 将过滤条件和时间范围转换为 bool 查询
+func filterQuery(f *EventFilter, since, until time.Time) map[string]interface{} {
+	filter, mustNot := f.clauses()
+	if timeRange := timeRangeFilter(since, until); timeRange != nil {
+		filter = append(filter, timeRange)
+	}
+	// 没有条件时空的 bool 查询匹配所有文档
+	boolQuery := map[string]interface{}{}
+	if len(filter) > 0 {
+		boolQuery["filter"] = filter
+	}
+	if len(mustNot) > 0 {
+		boolQuery["must_not"] = mustNot
+	}
+	return map[string]interface{}{"bool": boolQuery}
+}
+
+// timeRangeFilter 返回 @timestamp 的范围条件，包含 since，不包含 until。
+// 早期版本写入的文档没有 @timestamp，按 LastTimestamp 过滤
+func timeRangeFilter(since, until time.Time) map[string]interface{} {
+	if since.IsZero() && until.IsZero() {
+		return nil
+	}
+	r := map[string]interface{}{}
+	if !since.IsZero() {
+		r["gte"] = since.UTC().Format(time.RFC3339Nano)
+	}
+	if !until.IsZero() {
+		r["lt"] = until.UTC().Format(time.RFC3339Nano)
+	}
+	rangeOf := func(field string) map[string]interface{} {
+		return map[string]interface{}{"range": map[string]interface{}{field: r}}
+	}
+	return anyOf(
+		rangeOf("@timestamp"),
+		map[string]interface{}{"bool": map[string]interface{}{
+			"must_not": exists("@timestamp"),
+			"filter":   rangeOf("LastTimestamp"),
+		}},
+	)
+}
+
+// ObjectRef 是 namespace 内的一个对象
+type ObjectRef struct {
+	Kind string
+	Name string
+}
+
+// WorkloadQuery 是查询工作负载事件时间线的条件，Since 和 Until 为零值时不限制
+type WorkloadQuery struct {
+	Namespace string
+	Workload  ObjectRef
+	// 当前仍存在的下属对象
+	Resources []ObjectRef
+	Since     time.Time
+	Until     time.Time
+	Size      int
+}
+
+// SearchWorkloadEvents 查询工作负载及其下属对象最新的 Size 个事件，按发生时间升序返回，
+// Total 大于返回的事件数时表示结果被截断。
+// 下属对象包括 Resources 中的对象，以及 enrich 时记录的 workload 为该工作负载的所有对象
+func (c *ESClient) SearchWorkloadEvents(ctx context.Context, q *WorkloadQuery) (*SearchResult, error) {
+	workload := q.Workload
+	should := []map[string]interface{}{
+		{"bool": map[string]interface{}{"filter": []map[string]interface{}{
+			term("WorkloadKind", workload.Kind),
+			term("WorkloadName", workload.Name),
+		}}},
+	}
+	// 同一类型的对象合并为一个 terms 查询
+	names := map[string][]string{workload.Kind: {workload.Name}}
+	for _, r := range q.Resources {
+		names[r.Kind] = append(names[r.Kind], r.Name)
+	}
+	kinds := make([]string, 0, len(names))
+	for kind := range names {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		should = append(should, map[string]interface{}{
+			"bool": map[string]interface{}{"filter": []map[string]interface{}{
+				term("InvolvedObjectKind", kind),
+				{"terms": map[string]interface{}{"InvolvedObjectName": names[kind]}},
+			}},
+		})
+	}
+
+	filter := []map[string]interface{}{term("InvolvedObjectNamespace", q.Namespace)}
+	if timeRange := timeRangeFilter(q.Since, q.Until); timeRange != nil {
+		filter = append(filter, timeRange)
+	}
+	// 按时间倒序取最新的事件，再反转为升序的时间线
+	query := map[string]interface{}{
+		"size":             q.Size,
+		"sort":             eventSort(false),
+		"track_total_hits": true,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter":               filter,
+				"should":               should,
+				"minimum_should_match": 1,
+			},
+		},
+	}
+	result, err := c.searchDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	docs := result.Documents
+	for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+		docs[i], docs[j] = docs[j], docs[i]
+	}
+	result.NextPageToken = ""
+	return result, nil
+}
@@ -0,0 +1,95 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newSearchServer 对查询请求返回 response，并记录请求体
+func newSearchServer(t *testing.T, response string) (*ESClient, *map[string]interface{}) {
+	var request map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `{"version":{"number":"7.17.10","build_flavor":"default"}}`)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if len(body) > 0 {
+			json.Unmarshal(body, &request)
+		}
+		fmt.Fprint(w, response)
+	}))
+	t.Cleanup(srv.Close)
+	client, err := NewES(&ESConfig{Hosts: []string{srv.URL}, Index: DefaultIndexConfig()})
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+	return client, &request
+}
+
+func TestSearchWorkloadEventsReturnsLatestAscending(t *testing.T) {
+	// es 按时间倒序返回最新的两个事件
+	client, request := newSearchServer(t, `{"hits":{"total":{"value":5},"hits":[
+		{"_id":"3","_source":{"Name":"api.3"},"sort":[3]},
+		{"_id":"2","_source":{"Name":"api.2"},"sort":[2]}
+	]}}`)
+	since := time.Date(2024, 4, 12, 0, 0, 0, 0, time.UTC)
+	result, err := client.SearchWorkloadEvents(context.Background(), &WorkloadQuery{
+		Namespace: "payments",
+		Workload:  ObjectRef{Kind: "Deployment", Name: "api"},
+		Since:     since,
+		Size:      2,
+	})
+	if err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+
+	sort := (*request)["sort"].([]interface{})[0].(map[string]interface{})["@timestamp"].(map[string]interface{})
+	if sort["order"] != "desc" {
+		t.Errorf("expected the latest events to be requested, got sort %v", sort)
+	}
+	filter := (*request)["query"].(map[string]interface{})["bool"].(map[string]interface{})["filter"].([]interface{})
+	if len(filter) != 2 {
+		t.Errorf("expected namespace and time range filters, got %v", filter)
+	}
+	if len(result.Documents) != 2 || result.Documents[0].Name != "api.2" || result.Documents[1].Name != "api.3" {
+		t.Errorf("expected events in ascending order, got %+v", result.Documents)
+	}
+	if result.Total != 5 || result.NextPageToken != "" {
+		t.Errorf("unexpected total %d or page token %q", result.Total, result.NextPageToken)
+	}
+}
+
+func TestSearchEventsTimeRangeFallsBackToLastTimestamp(t *testing.T) {
+	client, request := newSearchServer(t, `{"hits":{"total":{"value":0},"hits":[]}}`)
+	since := time.Date(2024, 4, 12, 0, 0, 0, 0, time.UTC)
+	if _, err := client.SearchEvents(context.Background(), &EventQuery{Since: since, PageSize: 10}); err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+
+	filter := (*request)["query"].(map[string]interface{})["bool"].(map[string]interface{})["filter"].([]interface{})
+	if len(filter) != 1 {
+		t.Fatalf("expected only the time range filter, got %v", filter)
+	}
+	// @timestamp 或者没有 @timestamp 时的 LastTimestamp 满足范围即可
+	should := filter[0].(map[string]interface{})["bool"].(map[string]interface{})["should"].([]interface{})
+	if len(should) != 2 {
+		t.Fatalf("expected two alternatives, got %v", should)
+	}
+	if _, ok := should[0].(map[string]interface{})["range"].(map[string]interface{})["@timestamp"]; !ok {
+		t.Errorf("expected a range on @timestamp, got %v", should[0])
+	}
+	legacy := should[1].(map[string]interface{})["bool"].(map[string]interface{})
+	lastTimestamp := legacy["filter"].(map[string]interface{})["range"].(map[string]interface{})["LastTimestamp"].(map[string]interface{})
+	if lastTimestamp["gte"] != since.Format(time.RFC3339Nano) || legacy["must_not"] == nil {
+		t.Errorf("expected documents without @timestamp to be filtered by LastTimestamp, got %v", legacy)
+	}
+}
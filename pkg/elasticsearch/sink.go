@@ -0,0 +1,162 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
+	"k8s.io/klog/v2"
+	"sync"
+)
+
+const SinkName = "elasticsearch"
+
+type SinkConfig struct {
+	// 为 nil 时逐条写入
+	Bulk *BulkConfig
+	// 文档写入模式：latest 或 history
+	DocumentMode string
+}
+
+// ESSink 将事件写入 elasticsearch，实现 sink.Sink 接口
+type ESSink struct {
+	client       *ESClient
+	documentMode string
+	bulk         *BulkIndexer
+	onFailure    sink.FailureHandler
+
+	// 模板和 ILM 策略只需初始化一次，索引按天懒创建
+	locker       sync.Mutex
+	bootstrapped bool
+	indices      map[string]struct{}
+}
+
+func NewSink(client *ESClient, cfg *SinkConfig) (*ESSink, error) {
+	if client.cfg.Index.DataStream && cfg.DocumentMode != DocumentModeHistory {
+		return nil, fmt.Errorf("data stream only supports the %s document mode", DocumentModeHistory)
+	}
+	s := &ESSink{
+		client:       client,
+		documentMode: cfg.DocumentMode,
+		indices:      map[string]struct{}{},
+	}
+	if cfg.Bulk != nil {
+		s.bulk = NewBulkIndexer(client, cfg.Bulk)
+	}
+	return s, nil
+}
+
+func (s *ESSink) Name() string {
+	return SinkName
+}
+
+func (s *ESSink) SetFailureHandler(handler sink.FailureHandler) {
+	s.onFailure = handler
+}
+
+// ensureIndex 在第一次写入某个周期的索引前完成模板、ILM 策略和索引的初始化，
+// 失败时下次写入会重新尝试
+func (s *ESSink) ensureIndex(indexName string) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if !s.bootstrapped {
+		if err := s.bootstrap(); err != nil {
+			return err
+		}
+		s.bootstrapped = true
+	}
+
+	if _, ok := s.indices[indexName]; ok {
+		return nil
+	}
+	if s.client.cfg.Index.DataStream {
+		if err := s.client.CreateDataStream(indexName); err != nil {
+			return err
+		}
+	} else {
+		// 创建 es 索引
+		if err := s.client.CreateIndex(indexName); err != nil {
+			return err
+		}
+	}
+	s.indices[indexName] = struct{}{}
+	return nil
+}
+
+func (s *ESSink) bootstrap() error {
+	cfg := s.client.cfg.Index
+	// init ilm
+	if cfg.ManageILM {
+		if err := s.client.InitLifecyclePolicy(); err != nil {
+			return err
+		}
+	}
+	// init index template
+	if cfg.ManageTemplate {
+		return s.client.InitTemplates()
+	}
+	return nil
+}
+
+func (s *ESSink) Write(ctx context.Context, event *sink.Event) error {
+	// data stream 只允许 create，文档不可覆盖
+	cfg := s.client.cfg.Index
+	indexName, opType := cfg.IndexNameFor(cfg.IndexTime(event.Event, s.documentMode)), OpTypeIndex
+	if cfg.DataStream {
+		indexName, opType = cfg.DataStreamName(), OpTypeCreate
+	}
+	if err := s.ensureIndex(indexName); err != nil {
+		return err
+	}
+
+	documentID := DocumentID(event.Event, s.documentMode)
+	if s.bulk == nil {
+		return s.client.SyncEventItem(event, indexName, documentID, opType)
+	}
+
+	body, err := json.Marshal(NewEventDocument(event))
+	if err != nil {
+		return sink.Permanent(fmt.Errorf("error marshaling event: %s", err))
+	}
+	key := fmt.Sprintf("%s/%s", event.Namespace, event.Name)
+	return s.bulk.Add(ctx, &BulkItem{
+		Index:      indexName,
+		DocumentID: documentID,
+		OpType:     opType,
+		Body:       body,
+		OnFailure: func(err error) {
+			klog.Errorf("bulk index event %s failed: %v", key, err)
+			if s.onFailure != nil && IsRetryable(err) {
+				s.onFailure(event, err)
+			}
+		},
+	})
+}
+
+func (s *ESSink) Flush(ctx context.Context) error {
+	if s.bulk == nil {
+		return nil
+	}
+	return s.bulk.Flush(ctx)
+}
+
+func (s *ESSink) Close() error {
+	if s.bulk == nil {
+		return nil
+	}
+	return s.bulk.Close()
+}
+
+func (s *ESSink) Healthy(ctx context.Context) error {
+	res, err := s.client.api.Ping(s.client.api.Ping.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("elasticsearch ping failed: %s", res.String())
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Dimension 是统计时分组的字段
+type Dimension string
+
+const (
+	DimensionNamespace Dimension = "InvolvedObjectNamespace"
+	DimensionKind      Dimension = "InvolvedObjectKind"
+	DimensionName      Dimension = "InvolvedObjectName"
+	DimensionReason    Dimension = "Reason"
+	DimensionType      Dimension = "Type"
+	DimensionNode      Dimension = "NodeName"
+	DimensionComponent Dimension = "Component"
+	DimensionWorkload  Dimension = "Workload"
+)
+
+// componentScript 与采集时的 component 过滤规则一致，优先使用 ReportingController，
+// events.k8s.io/v1 的事件只有 ReportingController，core/v1 的事件只有 SourceComponent
+const componentScript = `for (String field : ['ReportingController', 'SourceComponent']) {
+  if (doc.containsKey(field) && doc[field].size() > 0 && doc[field].value != '') {
+    return doc[field].value;
+  }
+}
+return null;`
+
+// workloadScript 按 Kind/Name 分组，不同类型的同名工作负载分开统计，没有补充工作负载的事件不参与分组
+const workloadScript = `if (!doc.containsKey('WorkloadName') || doc['WorkloadName'].size() == 0) {
+  return null;
+}
+String kind = doc.containsKey('WorkloadKind') && doc['WorkloadKind'].size() > 0 ? doc['WorkloadKind'].value : '';
+return kind + '/' + doc['WorkloadName'].value;`
+
+// dimensionScripts 是没有对应字段、需要用脚本计算分组值的维度
+var dimensionScripts = map[Dimension]string{
+	DimensionComponent: componentScript,
+	DimensionWorkload:  workloadScript,
+}
+
+// StatsQuery 是统计事件的条件。GroupBy 依次嵌套 terms 聚合，每层取 Size 个桶；
+// Interval 不为 0 时在最内层按时间分桶
+type StatsQuery struct {
+	Filter   EventFilter
+	Since    time.Time
+	Until    time.Time
+	GroupBy  []Dimension
+	Interval time.Duration
+	Size     int
+	// 为 true 时统计事件发生的次数（Count 之和），否则统计事件文档数
+	SumCount bool
+}
+
+// StatsBucket 是展开后的一个桶，Keys 与 GroupBy 一一对应，未按时间分桶时 Time 为零值
+type StatsBucket struct {
+	Keys  []string
+	Time  time.Time
+	Value int64
+}
+
+// StatsResult 中的桶按聚合返回的顺序排列，即每层按 Value 降序，时间升序
+type StatsResult struct {
+	Buckets []StatsBucket
+	// 满足条件的事件文档数
+	Total int64
+}
+
+const (
+	groupAggName       = "group"
+	timeAggName        = "time"
+	occurrencesAggName = "occurrences"
+)
+
+// aggBucket 是 terms 和 date_histogram 聚合返回的桶
+type aggBucket struct {
+	Key         interface{} `json:"key"`
+	KeyAsString string      `json:"key_as_string"`
+	DocCount    int64       `json:"doc_count"`
+	Occurrences *struct {
+		Value float64 `json:"value"`
+	} `json:"occurrences"`
+	Group *aggResult `json:"group"`
+	Time  *aggResult `json:"time"`
+}
+
+type aggResult struct {
+	Buckets []aggBucket `json:"buckets"`
+}
+
+// EventStats 按维度和时间统计事件
+func (c *ESClient) EventStats(ctx context.Context, q *StatsQuery) (*StatsResult, error) {
+	query := map[string]interface{}{
+		"size":  0,
+		"query": filterQuery(&q.Filter, q.Since, q.Until),
+	}
+	if aggs := q.aggregations(0); aggs != nil {
+		query["aggs"] = aggs
+	}
+	r, err := c.search(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &StatsResult{Total: r.Hits.Total.Value}
+	if len(r.Aggregations) == 0 {
+		return result, nil
+	}
+	var root aggBucket
+	if err := json.Unmarshal(r.Aggregations, &root); err != nil {
+		return nil, fmt.Errorf("error parsing aggregations: %s", err)
+	}
+	q.flatten(&root, nil, &result.Buckets)
+	return result, nil
+}
+
+// aggregations 返回第 level 层的聚合，level 超过 GroupBy 时为时间分桶
+func (q *StatsQuery) aggregations(level int) map[string]interface{} {
+	var name string
+	var agg map[string]interface{}
+	switch {
+	case level < len(q.GroupBy):
+		terms := map[string]interface{}{"size": q.Size}
+		if script, ok := dimensionScripts[q.GroupBy[level]]; ok {
+			terms["script"] = map[string]interface{}{"source": script, "lang": "painless"}
+		} else {
+			terms["field"] = string(q.GroupBy[level])
+		}
+		if q.SumCount {
+			terms["order"] = map[string]interface{}{occurrencesAggName: "desc"}
+		}
+		name, agg = groupAggName, map[string]interface{}{"terms": terms}
+	case level == len(q.GroupBy) && q.Interval > 0:
+		name, agg = timeAggName, map[string]interface{}{
+			"date_histogram": map[string]interface{}{
+				"field":          "@timestamp",
+				"fixed_interval": fmt.Sprintf("%ds", int64(q.Interval/time.Second)),
+				"min_doc_count":  1,
+			},
+		}
+	default:
+		return nil
+	}
+
+	subAggs := q.aggregations(level + 1)
+	if q.SumCount {
+		if subAggs == nil {
+			subAggs = map[string]interface{}{}
+		}
+		subAggs[occurrencesAggName] = map[string]interface{}{"sum": map[string]interface{}{"field": "Count"}}
+	}
+	if subAggs != nil {
+		agg["aggs"] = subAggs
+	}
+	return map[string]interface{}{name: agg}
+}
+
+// flatten 将嵌套的桶展开为叶子桶
+func (q *StatsQuery) flatten(b *aggBucket, keys []string, buckets *[]StatsBucket) {
+	switch {
+	case b.Group != nil:
+		for i := range b.Group.Buckets {
+			child := &b.Group.Buckets[i]
+			q.flatten(child, append(keys[:len(keys):len(keys)], fmt.Sprint(child.Key)), buckets)
+		}
+	case b.Time != nil:
+		for _, child := range b.Time.Buckets {
+			bucket := StatsBucket{Keys: keys, Value: q.value(&child)}
+			if ms, ok := child.Key.(float64); ok {
+				bucket.Time = time.UnixMilli(int64(ms)).UTC()
+			}
+			*buckets = append(*buckets, bucket)
+		}
+	default:
+		if len(keys) > 0 {
+			*buckets = append(*buckets, StatsBucket{Keys: keys, Value: q.value(b)})
+		}
+	}
+}
+
+func (q *StatsQuery) value(b *aggBucket) int64 {
+	if q.SumCount && b.Occurrences != nil {
+		return int64(b.Occurrences.Value)
+	}
+	return b.DocCount
+}
@@ -0,0 +1,77 @@
+package elasticsearch
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEventStatsGroupsByComponent(t *testing.T) {
+	client, request := newSearchServer(t, `{"hits":{"total":{"value":3}},"aggregations":{"group":{"buckets":[
+		{"key":"kubelet","doc_count":2,"group":{"buckets":[{"key":"BackOff","doc_count":2}]}},
+		{"key":"default-scheduler","doc_count":1,"group":{"buckets":[{"key":"FailedScheduling","doc_count":1}]}}
+	]}}}`)
+	result, err := client.EventStats(context.Background(), &StatsQuery{
+		GroupBy: []Dimension{DimensionComponent, DimensionReason},
+		Size:    10,
+	})
+	if err != nil {
+		t.Fatalf("stats failed: %v", err)
+	}
+
+	// component 按 ReportingController 和 SourceComponent 合并后的值分组
+	group := (*request)["aggs"].(map[string]interface{})["group"].(map[string]interface{})
+	terms := group["terms"].(map[string]interface{})
+	script, ok := terms["script"].(map[string]interface{})
+	if !ok || terms["field"] != nil {
+		t.Fatalf("expected component to be grouped by script, got %v", terms)
+	}
+	if source := script["source"].(string); !strings.Contains(source, "ReportingController") || !strings.Contains(source, "SourceComponent") {
+		t.Errorf("expected script to combine both component fields, got %q", source)
+	}
+	reason := group["aggs"].(map[string]interface{})["group"].(map[string]interface{})["terms"].(map[string]interface{})
+	if reason["field"] != string(DimensionReason) {
+		t.Errorf("expected reason to be grouped by field, got %v", reason)
+	}
+
+	expected := []StatsBucket{
+		{Keys: []string{"kubelet", "BackOff"}, Value: 2},
+		{Keys: []string{"default-scheduler", "FailedScheduling"}, Value: 1},
+	}
+	if !reflect.DeepEqual(result.Buckets, expected) || result.Total != 3 {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestEventStatsGroupsByWorkloadKindAndName(t *testing.T) {
+	client, request := newSearchServer(t, `{"hits":{"total":{"value":3}},"aggregations":{"group":{"buckets":[
+		{"key":"Deployment/nginx","doc_count":2},
+		{"key":"StatefulSet/nginx","doc_count":1}
+	]}}}`)
+	result, err := client.EventStats(context.Background(), &StatsQuery{
+		GroupBy: []Dimension{DimensionWorkload},
+		Size:    10,
+	})
+	if err != nil {
+		t.Fatalf("stats failed: %v", err)
+	}
+
+	// 同名的不同类型工作负载分开分组
+	terms := (*request)["aggs"].(map[string]interface{})["group"].(map[string]interface{})["terms"].(map[string]interface{})
+	script, ok := terms["script"].(map[string]interface{})
+	if !ok || terms["field"] != nil {
+		t.Fatalf("expected workload to be grouped by script, got %v", terms)
+	}
+	if source := script["source"].(string); !strings.Contains(source, "WorkloadKind") || !strings.Contains(source, "WorkloadName") {
+		t.Errorf("expected script to combine workload kind and name, got %q", source)
+	}
+
+	expected := []StatsBucket{
+		{Keys: []string{"Deployment/nginx"}, Value: 2},
+		{Keys: []string{"StatefulSet/nginx"}, Value: 1},
+	}
+	if !reflect.DeepEqual(result.Buckets, expected) {
+		t.Errorf("unexpected buckets %+v", result.Buckets)
+	}
+}
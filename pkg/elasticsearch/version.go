@@ -0,0 +1,188 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"io"
+	"k8s.io/klog/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 后端发行版
+const (
+	DistributionAuto          = "auto"
+	DistributionElasticsearch = "elasticsearch"
+	DistributionOpenSearch    = "opensearch"
+)
+
+const detectTimeout = 10 * time.Second
+
+// 指定发行版但未指定版本时假定的版本
+var defaultServerVersions = map[string]string{
+	DistributionElasticsearch: "8.0.0",
+	DistributionOpenSearch:    "2.0.0",
+}
+
+// ServerInfo 描述连接的后端发行版和版本
+type ServerInfo struct {
+	Distribution string
+	Version      string
+	Major        int64
+	Minor        int64
+}
+
+func (s *ServerInfo) String() string {
+	return fmt.Sprintf("%s %s", s.Distribution, s.Version)
+}
+
+func (s *ServerInfo) IsOpenSearch() bool {
+	return s.Distribution == DistributionOpenSearch
+}
+
+// SupportsComposableTemplate es 7.8 开始支持 _index_template，
+// es 8 已废弃 legacy _template
+func (s *ServerInfo) SupportsComposableTemplate() bool {
+	return s.IsOpenSearch() || s.Major > 7 || s.Major == 7 && s.Minor >= 8
+}
+
+// SupportsDataStream es 7.9 开始支持 data stream
+func (s *ServerInfo) SupportsDataStream() bool {
+	return s.IsOpenSearch() || s.Major > 7 || s.Major == 7 && s.Minor >= 9
+}
+
+// needsCompatHeader es 8 需要兼容头才能按 7.x 的格式处理 v7 客户端的请求
+func (s *ServerInfo) needsCompatHeader() bool {
+	return !s.IsOpenSearch() && s.Major >= 8
+}
+
+// parseServerInfo 解析 GET / 的响应
+func parseServerInfo(body []byte) (*ServerInfo, error) {
+	var r struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("error parsing the info response body: %s", err)
+	}
+
+	distribution := DistributionElasticsearch
+	if r.Version.Distribution == DistributionOpenSearch {
+		distribution = DistributionOpenSearch
+	}
+	return newServerInfo(distribution, r.Version.Number)
+}
+
+func newServerInfo(distribution, version string) (*ServerInfo, error) {
+	major, minor, _, err := elasticsearch.ParseElasticsearchVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s version %q", distribution, version)
+	}
+	return &ServerInfo{
+		Distribution: distribution,
+		Version:      version,
+		Major:        major,
+		Minor:        minor,
+	}, nil
+}
+
+// serverDetector 第一次请求时探测后端版本，探测失败时下次请求重新探测
+type serverDetector struct {
+	client *elasticsearch.Client
+	cfg    *ESConfig
+
+	locker sync.Mutex
+	info   *ServerInfo
+}
+
+func (d *serverDetector) get(ctx context.Context) (*ServerInfo, error) {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+
+	if d.info != nil {
+		return d.info, nil
+	}
+
+	if d.cfg.Distribution != "" && d.cfg.Distribution != DistributionAuto {
+		version := d.cfg.ServerVersion
+		if version == "" {
+			version = defaultServerVersions[d.cfg.Distribution]
+		}
+		info, err := newServerInfo(d.cfg.Distribution, version)
+		if err != nil {
+			return nil, err
+		}
+		d.info = info
+		return info, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, detectTimeout)
+	defer cancel()
+	req := esapi.InfoRequest{}
+	// 使用底层 transport，跳过 go-elasticsearch 的产品校验
+	res, err := req.Do(ctx, d.client.Transport)
+	if err != nil {
+		return nil, fmt.Errorf("error detecting server version: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error detecting server version: %s", res.String())
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the info response body: %s", err)
+	}
+	info, err := parseServerInfo(body)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("detected storage backend %s", info)
+	d.info = info
+	return info, nil
+}
+
+// es 8 的兼容头，_bulk 和 _msearch 的请求体是 ndjson
+const (
+	compatJSON   = "application/vnd.elasticsearch+json;compatible-with=7"
+	compatNDJSON = "application/vnd.elasticsearch+x-ndjson;compatible-with=7"
+)
+
+// compatTransport 是所有请求使用的 transport。OpenSearch 不返回 X-Elastic-Product 头，
+// 会被 go-elasticsearch 的产品校验拒绝，因此直接使用底层 transport；es 8 额外带上兼容头
+type compatTransport struct {
+	client   *elasticsearch.Client
+	detector *serverDetector
+}
+
+func (t *compatTransport) Perform(req *http.Request) (*http.Response, error) {
+	info, err := t.detector.get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	if info.needsCompatHeader() {
+		if req.Body != nil {
+			contentType := compatJSON
+			if isNDJSONPath(req.URL.Path) {
+				contentType = compatNDJSON
+			}
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("Accept", compatJSON)
+	}
+	return t.client.Transport.Perform(req)
+}
+
+// isNDJSONPath 判断请求体是否为 ndjson，esapi 对这些接口也设置 application/json
+func isNDJSONPath(path string) bool {
+	path = strings.TrimSuffix(path, "/")
+	return strings.HasSuffix(path, "/_bulk") || strings.HasSuffix(path, "/_msearch") ||
+		strings.HasSuffix(path, "/_msearch/template")
+}
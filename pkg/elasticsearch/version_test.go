@@ -0,0 +1,269 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
+	"io"
+	v1api "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer 模拟 es/OpenSearch 的 HTTP 接口，记录收到的请求
+type fakeServer struct {
+	distribution string
+	version      string
+
+	locker   sync.Mutex
+	requests []string
+	headers  map[string]http.Header
+	bodies   map[string]string
+}
+
+func newFakeServer(t *testing.T, distribution, version string) (*fakeServer, *httptest.Server) {
+	f := &fakeServer{
+		distribution: distribution,
+		version:      version,
+		headers:      map[string]http.Header{},
+		bodies:       map[string]string{},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeServer) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	key := r.Method + " " + r.URL.Path
+
+	f.locker.Lock()
+	f.requests = append(f.requests, key)
+	f.headers[key] = r.Header.Clone()
+	f.bodies[key] = string(body)
+	f.locker.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if f.distribution == DistributionElasticsearch {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/":
+		info := map[string]interface{}{"number": f.version, "build_flavor": "default"}
+		if f.distribution == DistributionOpenSearch {
+			info["distribution"] = DistributionOpenSearch
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"version": info, "tagline": "You Know, for Search"})
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, ismPolicyPath):
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"type":"status_exception"}}`)
+	case strings.Contains(r.URL.Path, "/_doc/") || strings.Contains(r.URL.Path, "/_create/"):
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"result":"created"}`)
+	default:
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	}
+}
+
+func (f *fakeServer) received(key string) bool {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	for _, r := range f.requests {
+		if r == key {
+			return true
+		}
+	}
+	return false
+}
+
+func testEvent() *v1api.Event {
+	ts := v1.NewTime(time.Date(2024, 4, 12, 3, 17, 16, 0, time.UTC))
+	return &v1api.Event{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "argocd-server-7965b94c48-z99hk.17c56a0cb01da61c",
+			Namespace: "argocd",
+			UID:       "6b9f7f0e-6a43-4e0c-9d37-5a3c8ad1c0f1",
+		},
+		InvolvedObject: v1api.ObjectReference{Kind: "Pod", Namespace: "argocd", Name: "argocd-server-7965b94c48-z99hk"},
+		Reason:         "Killing",
+		Message:        "Stopping container server",
+		Type:           "Normal",
+		Count:          1,
+		FirstTimestamp: ts,
+		LastTimestamp:  ts,
+	}
+}
+
+func TestParseServerInfo(t *testing.T) {
+	tests := []struct {
+		body         string
+		expected     string
+		major        int64
+		composable   bool
+		dataStream   bool
+		compatHeader bool
+	}{
+		{`{"version":{"number":"7.7.1"}}`, DistributionElasticsearch, 7, false, false, false},
+		{`{"version":{"number":"7.17.10"}}`, DistributionElasticsearch, 7, true, true, false},
+		{`{"version":{"number":"8.11.0"}}`, DistributionElasticsearch, 8, true, true, true},
+		{`{"version":{"number":"2.11.0","distribution":"opensearch"}}`, DistributionOpenSearch, 2, true, true, false},
+	}
+	for _, test := range tests {
+		info, err := parseServerInfo([]byte(test.body))
+		if err != nil {
+			t.Fatalf("parse %s failed: %v", test.body, err)
+		}
+		if info.Distribution != test.expected || info.Major != test.major {
+			t.Errorf("parse %s: got %s major %d", test.body, info, info.Major)
+		}
+		if info.SupportsComposableTemplate() != test.composable {
+			t.Errorf("%s: composable template support = %v", info, !test.composable)
+		}
+		if info.SupportsDataStream() != test.dataStream {
+			t.Errorf("%s: data stream support = %v", info, !test.dataStream)
+		}
+		if info.needsCompatHeader() != test.compatHeader {
+			t.Errorf("%s: compat header = %v", info, !test.compatHeader)
+		}
+	}
+}
+
+func TestSinkBootstrapPerBackend(t *testing.T) {
+	indexName := DefaultIndexPrefix + "-2024-04-12"
+	tests := []struct {
+		name         string
+		distribution string
+		version      string
+		expected     []string
+		unexpected   []string
+	}{
+		{
+			name:         "elasticsearch 7.7 uses legacy template",
+			distribution: DistributionElasticsearch,
+			version:      "7.7.1",
+			expected: []string{
+				"PUT /_ilm/policy/" + DefaultILMPolicyName,
+				"PUT /_template/" + DefaultIndexPrefix,
+				"PUT /" + indexName,
+			},
+			unexpected: []string{"PUT /_index_template/" + DefaultIndexPrefix},
+		},
+		{
+			name:         "elasticsearch 8 uses composable template",
+			distribution: DistributionElasticsearch,
+			version:      "8.11.0",
+			expected: []string{
+				"PUT /_ilm/policy/" + DefaultILMPolicyName,
+				"PUT /_index_template/" + DefaultIndexPrefix,
+				"PUT /" + indexName,
+			},
+			unexpected: []string{"PUT /_template/" + DefaultIndexPrefix},
+		},
+		{
+			name:         "opensearch 2 uses ism",
+			distribution: DistributionOpenSearch,
+			version:      "2.11.0",
+			expected: []string{
+				"GET " + ismPolicyPath + DefaultILMPolicyName,
+				"PUT " + ismPolicyPath + DefaultILMPolicyName,
+				"PUT /_index_template/" + DefaultIndexPrefix,
+				"PUT /" + indexName,
+			},
+			unexpected: []string{"PUT /_ilm/policy/" + DefaultILMPolicyName},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, srv := newFakeServer(t, test.distribution, test.version)
+			client, err := NewES(&ESConfig{Hosts: []string{srv.URL}, Index: DefaultIndexConfig()})
+			if err != nil {
+				t.Fatalf("create client failed: %v", err)
+			}
+			s, err := NewSink(client, &SinkConfig{DocumentMode: DocumentModeLatest})
+			if err != nil {
+				t.Fatalf("create sink failed: %v", err)
+			}
+			if err := s.Write(context.Background(), &sink.Event{Event: testEvent()}); err != nil {
+				t.Fatalf("write event failed: %v", err)
+			}
+
+			for _, key := range test.expected {
+				if !f.received(key) {
+					t.Errorf("expected request %q, got %v", key, f.requests)
+				}
+			}
+			for _, key := range test.unexpected {
+				if f.received(key) {
+					t.Errorf("unexpected request %q", key)
+				}
+			}
+
+			// OpenSearch 不认识 index.lifecycle.name
+			createIndexBody := f.bodies["PUT /"+indexName]
+			hasILM := strings.Contains(createIndexBody, "index.lifecycle.name")
+			if hasILM == (test.distribution == DistributionOpenSearch) {
+				t.Errorf("unexpected create index body for %s: %s", test.distribution, createIndexBody)
+			}
+
+			// es 8 需要兼容头
+			accept := f.headers["PUT /"+indexName].Get("Accept")
+			hasCompatHeader := strings.Contains(accept, "compatible-with=7")
+			if hasCompatHeader != (test.version == "8.11.0") {
+				t.Errorf("unexpected Accept header for %s %s: %q", test.distribution, test.version, accept)
+			}
+		})
+	}
+}
+
+func TestDataStreamRequiresSupport(t *testing.T) {
+	_, srv := newFakeServer(t, DistributionElasticsearch, "7.7.1")
+	index := DefaultIndexConfig()
+	index.DataStream = true
+	client, err := NewES(&ESConfig{Hosts: []string{srv.URL}, Index: index})
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+	s, err := NewSink(client, &SinkConfig{DocumentMode: DocumentModeHistory})
+	if err != nil {
+		t.Fatalf("create sink failed: %v", err)
+	}
+	if err := s.Write(context.Background(), &sink.Event{Event: testEvent()}); err == nil {
+		t.Errorf("expected data stream to be rejected by elasticsearch 7.7")
+	}
+}
+
+func TestCompatContentType(t *testing.T) {
+	f, srv := newFakeServer(t, DistributionElasticsearch, "8.11.0")
+	client, err := NewES(&ESConfig{Hosts: []string{srv.URL}, Index: DefaultIndexConfig()})
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+	ctx := context.Background()
+	bulk := esapi.BulkRequest{Body: strings.NewReader("{\"index\":{\"_index\":\"test\"}}\n{}\n")}
+	if _, err := bulk.Do(ctx, client.transport); err != nil {
+		t.Fatalf("bulk failed: %v", err)
+	}
+	search := esapi.SearchRequest{Index: []string{"test"}, Body: strings.NewReader("{}")}
+	if _, err := search.Do(ctx, client.transport); err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+
+	// _bulk 的请求体是 ndjson，其他请求是 json
+	if contentType := f.headers["POST /_bulk"].Get("Content-Type"); contentType != compatNDJSON {
+		t.Errorf("unexpected bulk Content-Type %q", contentType)
+	}
+	if contentType := f.headers["POST /test/_search"].Get("Content-Type"); contentType != compatJSON {
+		t.Errorf("unexpected search Content-Type %q", contentType)
+	}
+}
@@ -0,0 +1,170 @@
+package election
+
+import (
+	"context"
+	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/metrics"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config 是基于 Lease 的选主配置
+type Config struct {
+	Enabled       bool
+	Namespace     string
+	Name          string
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// Elector 保证多副本部署时只有一个副本采集事件，其他副本只提供查询
+type Elector struct {
+	client  kubernetes.Interface
+	cfg     *Config
+	leader  atomic.Bool
+	healthz *leaderelection.HealthzAdaptor
+}
+
+func New(client kubernetes.Interface, cfg *Config) *Elector {
+	return &Elector{
+		client: client,
+		cfg:    cfg,
+		// 租约过期后再多等待一段时间才认为续约失败
+		healthz: leaderelection.NewLeaderHealthzAdaptor(cfg.RenewDeadline),
+	}
+}
+
+// Run 成为 leader 后执行 run，ctx 结束时等待 run 返回后再释放租约，返回 run 的结果。
+// run 出错或失去 leader 时返回错误，由调用方退出进程，重启后重新参与选主
+func (e *Elector) Run(ctx context.Context, run func(ctx context.Context) error) error {
+	if !e.cfg.Enabled {
+		e.setLeader(true)
+		return run(ctx)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      e.cfg.Name,
+			Namespace: e.cfg.Namespace,
+		},
+		Client: e.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: e.cfg.Identity,
+		},
+	}
+
+	// 选主使用独立的 ctx：收到停止信号时还不是 leader 则直接退出选主，
+	// 已经是 leader 时等 run 返回后再停止续约并释放租约，避免释放租约后仍在写入
+	electorCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		locker  sync.Mutex
+		leading bool
+		stopped bool
+		done    = make(chan struct{})
+		runErr  error
+	)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-electorCtx.Done():
+			return
+		}
+		locker.Lock()
+		defer locker.Unlock()
+		stopped = true
+		if !leading {
+			cancel()
+		}
+	}()
+
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   e.cfg.LeaseDuration,
+		RenewDeadline:   e.cfg.RenewDeadline,
+		RetryPeriod:     e.cfg.RetryPeriod,
+		ReleaseOnCancel: true,
+		WatchDog:        e.healthz,
+		Name:            e.cfg.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				locker.Lock()
+				if stopped {
+					locker.Unlock()
+					return
+				}
+				leading = true
+				locker.Unlock()
+				defer close(done)
+
+				klog.Infof("%s became the leader", e.cfg.Identity)
+				e.setLeader(true)
+				// 收到停止信号或失去 leader 时停止 run
+				runCtx, stop := context.WithCancel(leaderCtx)
+				defer stop()
+				go func() {
+					select {
+					case <-ctx.Done():
+						stop()
+					case <-runCtx.Done():
+					}
+				}()
+				runErr = run(runCtx)
+				// run 返回后才释放租约，run 出错时也不再继续续约
+				cancel()
+			},
+			OnStoppedLeading: func() {
+				klog.Infof("%s stopped leading", e.cfg.Identity)
+				e.setLeader(false)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != e.cfg.Identity {
+					klog.Infof("current leader is %s", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create leader elector: %v", err)
+	}
+
+	klog.Infof("%s waiting for lease %s/%s", e.cfg.Identity, e.cfg.Namespace, e.cfg.Name)
+	le.Run(electorCtx)
+
+	// 失去 leader 时 le.Run 不等待 run 返回，需要等 run 完成最后的写入
+	locker.Lock()
+	wasLeading := leading
+	locker.Unlock()
+	if wasLeading {
+		<-done
+	}
+	if runErr != nil {
+		return runErr
+	}
+	if ctx.Err() == nil {
+		return fmt.Errorf("leader election lost")
+	}
+	return nil
+}
+
+func (e *Elector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Healthy leader 续约失败超时后返回错误，未开启选主或非 leader 时总是健康
+func (e *Elector) Healthy() error {
+	return e.healthz.Check(nil)
+}
+
+func (e *Elector) setLeader(leader bool) {
+	e.leader.Store(leader)
+	metrics.SetLeader(leader)
+}
@@ -0,0 +1,110 @@
+package election
+
+import (
+	"context"
+	"errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func testConfig() *Config {
+	return &Config{
+		Enabled:       true,
+		Namespace:     "default",
+		Name:          "k8s-event-collector",
+		Identity:      "collector-0",
+		LeaseDuration: 2 * time.Second,
+		RenewDeadline: time.Second,
+		RetryPeriod:   200 * time.Millisecond,
+	}
+}
+
+// holder 返回租约当前的持有者，释放后为空
+func holder(t *testing.T, client kubernetes.Interface, cfg *Config) string {
+	lease, err := client.CoordinationV1().Leases(cfg.Namespace).Get(context.Background(), cfg.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get lease failed: %v", err)
+	}
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func TestRunReleasesLeaseAfterRunReturns(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cfg := testConfig()
+	e := New(client, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	var holderOnExit string
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- e.Run(ctx, func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			// 模拟退出前的最后一次写入，此时仍应持有租约
+			time.Sleep(300 * time.Millisecond)
+			holderOnExit = holder(t, client, cfg)
+			return nil
+		})
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("did not become the leader")
+	}
+	if !e.IsLeader() {
+		t.Errorf("expected to be the leader")
+	}
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("run returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("run did not return after stop")
+	}
+	if holderOnExit != cfg.Identity {
+		t.Errorf("lease was released before run returned, holder %q", holderOnExit)
+	}
+	if h := holder(t, client, cfg); h != "" {
+		t.Errorf("expected lease to be released, holder %q", h)
+	}
+}
+
+func TestRunStopsLeadingWhenRunFails(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cfg := testConfig()
+	e := New(client, cfg)
+
+	runErr := errors.New("collector failed")
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- e.Run(context.Background(), func(context.Context) error {
+			return runErr
+		})
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, runErr) {
+			t.Fatalf("expected run error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("run error did not stop the elector")
+	}
+	if e.IsLeader() {
+		t.Errorf("expected to stop leading")
+	}
+	if h := holder(t, client, cfg); h != "" {
+		t.Errorf("expected lease to be released, holder %q", h)
+	}
+}
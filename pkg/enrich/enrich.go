@@ -0,0 +1,314 @@
+package enrich
+
+import (
+	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appsv1 "k8s.io/client-go/listers/apps/v1"
+	batchv1 "k8s.io/client-go/listers/batch/v1"
+	corev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	resync = time.Minute * 5
+	// owner 链的最大深度，防止 ownerReferences 成环
+	maxOwnerDepth = 5
+)
+
+// 等待新建的 informer 同步的最长时间，超时后只使用已经同步的缓存，
+// 没有权限或暂时无法同步的资源在同步完成前查不到
+var cacheSyncTimeout = 10 * time.Second
+
+type Config struct {
+	Enabled bool
+	// 只监听部分 namespace 时按 namespace 创建 informer，不需要集群范围的权限
+	Namespaced bool
+	// 需要附加的标签和注解，支持 glob
+	LabelAllowlist      []string
+	AnnotationAllowlist []string
+}
+
+// listers 是一个 namespace（或所有 namespace）内用于 enrich 的缓存
+type listers struct {
+	pods         corev1.PodLister
+	replicaSets  appsv1.ReplicaSetLister
+	deployments  appsv1.DeploymentLister
+	statefulSets appsv1.StatefulSetLister
+	daemonSets   appsv1.DaemonSetLister
+	jobs         batchv1.JobLister
+	cronJobs     batchv1.CronJobLister
+	nodes        corev1.NodeLister
+
+	// 缓存同步完成或超过 cacheSyncTimeout 后关闭
+	synced chan struct{}
+	// 关闭后停止该 namespace 的 informer
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func (l *listers) stop() {
+	l.stopOnce.Do(func() {
+		close(l.stopCh)
+	})
+}
+
+// Enricher 通过 informer 缓存查询事件涉及的对象，补充 owner 链、标签、节点和镜像。
+// informer 在第一次查询某个 namespace 时创建
+type Enricher struct {
+	client kubernetes.Interface
+	cfg    *Config
+	stopCh <-chan struct{}
+
+	locker  sync.Mutex
+	listers map[string]*listers
+	// Namespaced 时 collector 正在监听的 namespace，只为这些 namespace 创建 informer
+	namespaces map[string]bool
+}
+
+// New 返回 Enricher，未开启时返回 nil
+func New(client kubernetes.Interface, cfg *Config) *Enricher {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &Enricher{
+		client:     client,
+		cfg:        cfg,
+		listers:    map[string]*listers{},
+		namespaces: map[string]bool{},
+	}
+}
+
+// Start 设置 informer 的停止信号，需要在 Enrich 之前调用
+func (e *Enricher) Start(stopCh <-chan struct{}) {
+	if e == nil {
+		return
+	}
+	e.stopCh = stopCh
+}
+
+// Watch 允许为 namespace 创建 informer，collector 开始监听 namespace 时调用
+func (e *Enricher) Watch(namespace string) {
+	if e == nil || !e.cfg.Namespaced {
+		return
+	}
+	e.locker.Lock()
+	defer e.locker.Unlock()
+	e.namespaces[namespace] = true
+}
+
+// StopNamespace 停止 namespace 的 informer，collector 不再监听 namespace 时调用
+func (e *Enricher) StopNamespace(namespace string) {
+	if e == nil || !e.cfg.Namespaced {
+		return
+	}
+	e.locker.Lock()
+	l, ok := e.listers[namespace]
+	delete(e.listers, namespace)
+	delete(e.namespaces, namespace)
+	e.locker.Unlock()
+	if ok {
+		l.stop()
+		klog.Infof("stopped enrich informers for namespace %q", namespace)
+	}
+}
+
+// listersFor 返回 namespace 的缓存，第一次调用时在后台启动 informer。
+// 缓存最多等待 cacheSyncTimeout，不持有锁等待，避免阻塞其它 namespace 的查询
+func (e *Enricher) listersFor(namespace string) (*listers, error) {
+	key := metav1.NamespaceAll
+	if e.cfg.Namespaced {
+		key = namespace
+	}
+
+	e.locker.Lock()
+	if e.cfg.Namespaced && !e.namespaces[key] {
+		e.locker.Unlock()
+		return nil, fmt.Errorf("namespace %q is not watched", key)
+	}
+	l, ok := e.listers[key]
+	if !ok {
+		l = e.startListers(key)
+		e.listers[key] = l
+	}
+	e.locker.Unlock()
+
+	select {
+	case <-l.synced:
+		return l, nil
+	case <-l.stopCh:
+		return nil, fmt.Errorf("enrich informers for namespace %q are stopped", key)
+	}
+}
+
+// startListers 创建 namespace 的 informer 并在后台启动和等待同步，
+// 超过 cacheSyncTimeout 后记录未同步的 informer，先使用已经同步的缓存
+func (e *Enricher) startListers(key string) *listers {
+	factory := informers.NewSharedInformerFactoryWithOptions(e.client, resync, informers.WithNamespace(key))
+	l := &listers{
+		pods:         factory.Core().V1().Pods().Lister(),
+		replicaSets:  factory.Apps().V1().ReplicaSets().Lister(),
+		deployments:  factory.Apps().V1().Deployments().Lister(),
+		statefulSets: factory.Apps().V1().StatefulSets().Lister(),
+		daemonSets:   factory.Apps().V1().DaemonSets().Lister(),
+		jobs:         factory.Batch().V1().Jobs().Lister(),
+		cronJobs:     factory.Batch().V1().CronJobs().Lister(),
+		synced:       make(chan struct{}),
+		stopCh:       make(chan struct{}),
+	}
+	// Node 是集群范围的资源，只监听部分 namespace 时没有权限
+	if !e.cfg.Namespaced {
+		l.nodes = factory.Core().V1().Nodes().Lister()
+	}
+	go func() {
+		select {
+		case <-e.stopCh:
+			l.stop()
+		case <-l.stopCh:
+		}
+	}()
+	timeout := cacheSyncTimeout
+	go func() {
+		factory.Start(l.stopCh)
+		waitCh, done := make(chan struct{}), make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-time.After(timeout):
+			case <-l.stopCh:
+			case <-done:
+			}
+			close(waitCh)
+		}()
+
+		var unsynced []string
+		for informerType, ok := range factory.WaitForCacheSync(waitCh) {
+			if !ok {
+				unsynced = append(unsynced, informerType.String())
+			}
+		}
+		select {
+		case <-l.stopCh:
+			return
+		default:
+		}
+		if len(unsynced) > 0 {
+			sort.Strings(unsynced)
+			klog.Errorf("enrich informers %v of namespace %q have not synced within %v, enriching with the other informers", unsynced, key, timeout)
+		} else {
+			klog.Infof("started enrich informers for namespace %q", key)
+		}
+		close(l.synced)
+	}()
+	return l
+}
+
+// Enrich 返回事件涉及对象的元数据，对象不存在或不支持的类型只返回能确定的信息
+func (e *Enricher) Enrich(event *v1api.Event) *sink.Enrichment {
+	if e == nil {
+		return nil
+	}
+	ref := event.InvolvedObject
+	enrichment := &sink.Enrichment{
+		Workload: sink.OwnerReference{Kind: ref.Kind, Name: ref.Name},
+	}
+	// 集群范围的对象需要集群范围的权限
+	if e.cfg.Namespaced && ref.Namespace == "" {
+		return enrichment
+	}
+	l, err := e.listersFor(ref.Namespace)
+	if err != nil {
+		klog.V(2).Infof("skip enriching event %s/%s: %v", event.Namespace, event.Name, err)
+		return enrichment
+	}
+
+	obj := l.get(ref.Kind, ref.Namespace, ref.Name)
+	if obj == nil {
+		return enrichment
+	}
+
+	enrichment.Labels = filter(obj.GetLabels(), e.cfg.LabelAllowlist)
+	enrichment.Annotations = filter(obj.GetAnnotations(), e.cfg.AnnotationAllowlist)
+	switch o := obj.(type) {
+	case *v1api.Pod:
+		enrichment.NodeName = o.Spec.NodeName
+		for _, c := range o.Spec.Containers {
+			enrichment.Images = append(enrichment.Images, c.Image)
+		}
+	case *v1api.Node:
+		enrichment.NodeName = o.Name
+	}
+
+	// 沿 controller owner 向上查找，直到没有 owner 或 owner 不在缓存中
+	current := obj
+	for i := 0; i < maxOwnerDepth; i++ {
+		owner := metav1.GetControllerOf(current)
+		if owner == nil {
+			break
+		}
+		ownerRef := sink.OwnerReference{Kind: owner.Kind, Name: owner.Name}
+		enrichment.Owners = append(enrichment.Owners, ownerRef)
+		enrichment.Workload = ownerRef
+		if current = l.get(owner.Kind, ref.Namespace, owner.Name); current == nil {
+			break
+		}
+	}
+	return enrichment
+}
+
+// get 从缓存中查找对象，不支持的类型或不存在时返回 nil
+func (l *listers) get(kind, namespace, name string) metav1.Object {
+	var obj metav1.Object
+	var err error
+	switch kind {
+	case "Pod":
+		obj, err = l.pods.Pods(namespace).Get(name)
+	case "ReplicaSet":
+		obj, err = l.replicaSets.ReplicaSets(namespace).Get(name)
+	case "Deployment":
+		obj, err = l.deployments.Deployments(namespace).Get(name)
+	case "StatefulSet":
+		obj, err = l.statefulSets.StatefulSets(namespace).Get(name)
+	case "DaemonSet":
+		obj, err = l.daemonSets.DaemonSets(namespace).Get(name)
+	case "Job":
+		obj, err = l.jobs.Jobs(namespace).Get(name)
+	case "CronJob":
+		obj, err = l.cronJobs.CronJobs(namespace).Get(name)
+	case "Node":
+		if l.nodes == nil {
+			return nil
+		}
+		obj, err = l.nodes.Get(name)
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	return obj
+}
+
+// filter 返回 key 匹配允许列表的键值
+func filter(values map[string]string, allowlist []string) map[string]string {
+	var result map[string]string
+	for k, v := range values {
+		for _, pattern := range allowlist {
+			if ok, _ := path.Match(pattern, k); ok {
+				if result == nil {
+					result = map[string]string{}
+				}
+				result[k] = v
+				break
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,171 @@
+package enrich
+
+import (
+	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
+	appsv1 "k8s.io/api/apps/v1"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func controlledBy(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: kind, Name: name, Controller: &controller}}
+}
+
+func podEvent(namespace, name string) *v1api.Event {
+	return &v1api.Event{
+		ObjectMeta:     metav1.ObjectMeta{Namespace: namespace, Name: name + ".17c56a0cb01da61c"},
+		InvolvedObject: v1api.ObjectReference{Kind: "Pod", Namespace: namespace, Name: name},
+	}
+}
+
+func TestEnrichOwnerChain(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1api.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default", Name: "web-7d9c-x2k4f",
+				Labels:          map[string]string{"app": "web", "pod-template-hash": "7d9c"},
+				OwnerReferences: controlledBy("ReplicaSet", "web-7d9c"),
+			},
+			Spec: v1api.PodSpec{NodeName: "worker-1", Containers: []v1api.Container{{Image: "nginx:1.25"}}},
+		},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-7d9c", OwnerReferences: controlledBy("Deployment", "web")}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}},
+	)
+	e := New(client, &Config{Enabled: true, Namespaced: true, LabelAllowlist: []string{"app"}})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	e.Start(stopCh)
+	e.Watch("default")
+
+	expected := &sink.Enrichment{
+		Labels:   map[string]string{"app": "web"},
+		Owners:   []sink.OwnerReference{{Kind: "ReplicaSet", Name: "web-7d9c"}, {Kind: "Deployment", Name: "web"}},
+		Workload: sink.OwnerReference{Kind: "Deployment", Name: "web"},
+		NodeName: "worker-1",
+		Images:   []string{"nginx:1.25"},
+	}
+	if got := e.Enrich(podEvent("default", "web-7d9c-x2k4f")); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected enrichment:\n got: %+v\nwant: %+v", got, expected)
+	}
+}
+
+func TestEnrichDoesNotWaitForUnsyncedCache(t *testing.T) {
+	timeout := cacheSyncTimeout
+	cacheSyncTimeout = 2 * time.Second
+	defer func() { cacheSyncTimeout = timeout }()
+
+	// slow namespace 的 list 一直失败，缓存无法同步
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "slow" {
+			return true, nil, fmt.Errorf("pods is forbidden")
+		}
+		return false, nil, nil
+	})
+	e := New(client, &Config{Enabled: true, Namespaced: true})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	e.Start(stopCh)
+	e.Watch("default")
+	e.Watch("slow")
+
+	done := make(chan *sink.Enrichment)
+	go func() { done <- e.Enrich(podEvent("slow", "web-0")) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// 等待 slow namespace 同步时不能阻塞其它 namespace
+	start := time.Now()
+	e.Enrich(podEvent("default", "web-0"))
+	if elapsed := time.Since(start); elapsed > cacheSyncTimeout/2 {
+		t.Errorf("enriching another namespace took %v while a cache was syncing", elapsed)
+	}
+
+	select {
+	case got := <-done:
+		// 超时后只返回能确定的信息
+		if got.Workload != (sink.OwnerReference{Kind: "Pod", Name: "web-0"}) || got.Owners != nil {
+			t.Errorf("unexpected enrichment %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("enrich blocked on an unsynced cache")
+	}
+
+	// 超过 deadline 后不再等待
+	start = time.Now()
+	e.Enrich(podEvent("slow", "web-1"))
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("enrich waited %v after the sync deadline", elapsed)
+	}
+}
+
+// testPod 返回 default 中由 ReplicaSet web-7d9c 管理的 Pod
+func testPod() *v1api.Pod {
+	return &v1api.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: "web-7d9c-x2k4f",
+			Labels:          map[string]string{"app": "web"},
+			OwnerReferences: controlledBy("ReplicaSet", "web-7d9c"),
+		},
+		Spec: v1api.PodSpec{NodeName: "worker-1"},
+	}
+}
+
+func TestEnrichFallsBackToSyncedInformers(t *testing.T) {
+	timeout := cacheSyncTimeout
+	cacheSyncTimeout = 500 * time.Millisecond
+	defer func() { cacheSyncTimeout = timeout }()
+
+	// 没有 deployments 的权限，其它 informer 可以同步
+	client := fake.NewSimpleClientset(testPod())
+	client.PrependReactor("list", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("deployments.apps is forbidden")
+	})
+	e := New(client, &Config{Enabled: true, Namespaced: true, LabelAllowlist: []string{"app"}})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	e.Start(stopCh)
+	e.Watch("default")
+
+	got := e.Enrich(podEvent("default", "web-7d9c-x2k4f"))
+	if got.NodeName != "worker-1" || got.Labels["app"] != "web" {
+		t.Errorf("expected pod metadata from the synced informers, got %+v", got)
+	}
+	if len(got.Owners) != 1 || got.Owners[0] != (sink.OwnerReference{Kind: "ReplicaSet", Name: "web-7d9c"}) {
+		t.Errorf("expected owner chain up to the replicaset, got %+v", got.Owners)
+	}
+}
+
+func TestStopNamespace(t *testing.T) {
+	e := New(fake.NewSimpleClientset(testPod()), &Config{Enabled: true, Namespaced: true, LabelAllowlist: []string{"app"}})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	e.Start(stopCh)
+
+	// 没有监听的 namespace 不创建 informer
+	if got := e.Enrich(podEvent("default", "web-7d9c-x2k4f")); got.Labels != nil || len(e.listers) != 0 {
+		t.Fatalf("expected no informers for an unwatched namespace, got %+v", got)
+	}
+
+	e.Watch("default")
+	if got := e.Enrich(podEvent("default", "web-7d9c-x2k4f")); got.Labels["app"] != "web" {
+		t.Fatalf("expected labels of the pod, got %+v", got)
+	}
+	l := e.listers["default"]
+	e.StopNamespace("default")
+	select {
+	case <-l.stopCh:
+	default:
+		t.Errorf("expected informers of the namespace to be stopped")
+	}
+	if got := e.Enrich(podEvent("default", "web-7d9c-x2k4f")); got.Labels != nil || len(e.listers) != 0 {
+		t.Errorf("expected informers not to be recreated after the namespace is stopped, got %+v", got)
+	}
+}
@@ -0,0 +1,190 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/metrics"
+	v1api "k8s.io/api/core/v1"
+	"regexp"
+	"strings"
+)
+
+// 规则可以匹配的事件字段
+const (
+	FieldType      = "type"
+	FieldReason    = "reason"
+	FieldKind      = "kind"
+	FieldNamespace = "namespace"
+	FieldMessage   = "message"
+	FieldComponent = "component"
+)
+
+var fields = []string{FieldType, FieldReason, FieldKind, FieldNamespace, FieldMessage, FieldComponent}
+
+// Rule 匹配事件的一个字段。Pattern 默认按 glob 匹配，用 /.../ 包裹时按正则匹配
+type Rule struct {
+	Field   string
+	Pattern string
+	Exclude bool
+	match   func(string) bool
+}
+
+// ParseRule 解析 field=pattern 格式的规则，例如 namespace=kube-* 或 message=/(?i)back-off/
+func ParseRule(rule string, exclude bool) (*Rule, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid filter rule %q, must be field=pattern", rule)
+	}
+	r := &Rule{
+		Field:   strings.ToLower(strings.TrimSpace(parts[0])),
+		Pattern: parts[1],
+		Exclude: exclude,
+	}
+	if !validField(r.Field) {
+		return nil, fmt.Errorf("invalid filter rule %q, field must be one of %s", rule, strings.Join(fields, ", "))
+	}
+
+	if len(r.Pattern) > 1 && strings.HasPrefix(r.Pattern, "/") && strings.HasSuffix(r.Pattern, "/") {
+		re, err := regexp.Compile(r.Pattern[1 : len(r.Pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter rule %q: %v", rule, err)
+		}
+		r.match = re.MatchString
+		return r, nil
+	}
+	re, err := globRegexp(r.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter rule %q: %v", rule, err)
+	}
+	r.match = re.MatchString
+	return r, nil
+}
+
+// globRegexp 将 glob 转换为匹配整个值的正则。与 path.Match 不同，* 和 ? 也匹配 /，
+// 镜像地址、路径和 URL 中都有 /
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing closing ] in %q", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func validField(field string) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) String() string {
+	action := "include"
+	if r.Exclude {
+		action = "exclude"
+	}
+	return fmt.Sprintf("%s:%s=%s", action, r.Field, r.Pattern)
+}
+
+func (r *Rule) Match(event *v1api.Event) bool {
+	return r.match(fieldValue(event, r.Field))
+}
+
+func fieldValue(event *v1api.Event, field string) string {
+	switch field {
+	case FieldType:
+		return event.Type
+	case FieldReason:
+		return event.Reason
+	case FieldKind:
+		return event.InvolvedObject.Kind
+	case FieldNamespace:
+		return event.InvolvedObject.Namespace
+	case FieldMessage:
+		return event.Message
+	case FieldComponent:
+		// events.k8s.io/v1 的事件只有 reportingController
+		if event.ReportingController != "" {
+			return event.ReportingController
+		}
+		return event.Source.Component
+	}
+	return ""
+}
+
+// Filter 在事件入队前过滤事件。同一字段的 include 规则满足任意一条即可，
+// 不同字段的 include 规则需要同时满足；命中任意 exclude 规则的事件被丢弃
+type Filter struct {
+	includes map[string][]*Rule
+	excludes []*Rule
+}
+
+func New(rules ...*Rule) *Filter {
+	f := &Filter{includes: map[string][]*Rule{}}
+	for _, r := range rules {
+		if r.Exclude {
+			f.excludes = append(f.excludes, r)
+		} else {
+			f.includes[r.Field] = append(f.includes[r.Field], r)
+		}
+	}
+	return f
+}
+
+// Allow 返回事件是否需要采集，被丢弃时按规则计数
+func (f *Filter) Allow(event *v1api.Event) bool {
+	if f == nil {
+		return true
+	}
+	for _, field := range fields {
+		rules, ok := f.includes[field]
+		if !ok {
+			continue
+		}
+		if !matchAny(rules, event) {
+			metrics.AddFilterDropped("include:" + field)
+			return false
+		}
+	}
+	for _, r := range f.excludes {
+		if r.Match(event) {
+			metrics.AddFilterDropped(r.String())
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(rules []*Rule, event *v1api.Event) bool {
+	for _, r := range rules {
+		if r.Match(event) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package filter
+
+import (
+	v1api "k8s.io/api/core/v1"
+	"testing"
+)
+
+func testEvent() *v1api.Event {
+	return &v1api.Event{
+		InvolvedObject: v1api.ObjectReference{Kind: "Pod", Namespace: "kube-system"},
+		Type:           v1api.EventTypeWarning,
+		Reason:         "BackOff",
+		Message:        "Back-off restarting failed container",
+		Source:         v1api.EventSource{Component: "kubelet"},
+	}
+}
+
+func mustParse(t *testing.T, rule string, exclude bool) *Rule {
+	t.Helper()
+	r, err := ParseRule(rule, exclude)
+	if err != nil {
+		t.Fatalf("parse rule %q failed: %v", rule, err)
+	}
+	return r
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		rule  string
+		valid bool
+	}{
+		{"namespace=kube-*", true},
+		{"Reason = BackOff", true},
+		{"message=/(?i)back-off/", true},
+		{"message=/(/", false},
+		{"namespace=[", false},
+		{"node=worker-1", false},
+		{"namespace=", false},
+		{"namespace", false},
+	}
+	for _, test := range tests {
+		_, err := ParseRule(test.rule, false)
+		if (err == nil) != test.valid {
+			t.Errorf("parse %q: valid = %v, got error %v", test.rule, test.valid, err)
+		}
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	tests := []struct {
+		rule     string
+		expected bool
+	}{
+		{"namespace=kube-*", true},
+		{"namespace=default", false},
+		{"type=Warning", true},
+		{"kind=Deployment", false},
+		{"reason=Back*", true},
+		{"message=/(?i)^back-off/", true},
+		{"message=/^Pulled/", false},
+		{"component=kubelet", true},
+	}
+	event := testEvent()
+	for _, test := range tests {
+		if got := mustParse(t, test.rule, false).Match(event); got != test.expected {
+			t.Errorf("%s: match = %v, expected %v", test.rule, got, test.expected)
+		}
+	}
+}
+
+func TestGlobMatchesSlash(t *testing.T) {
+	event := testEvent()
+	event.Reason = "Pulling"
+	event.Message = "Pulling image docker.io/library/nginx:1.25"
+	event.InvolvedObject.Kind = "apps/v1"
+	tests := []struct {
+		rule     string
+		expected bool
+	}{
+		{"message=*image*", true},
+		{"message=*docker.io/library/*", true},
+		{"message=Pulling image ?ocker.io/*", true},
+		{"message=*image", false},
+		{"kind=apps/*", true},
+		{"kind=[!a]*", false},
+		{"reason=Pull[a-z]ng", true},
+	}
+	for _, test := range tests {
+		if got := mustParse(t, test.rule, false).Match(event); got != test.expected {
+			t.Errorf("%s: match = %v, expected %v", test.rule, got, test.expected)
+		}
+	}
+}
+
+func TestComponentPrefersReportingController(t *testing.T) {
+	event := testEvent()
+	event.ReportingController = "default-scheduler"
+	if !mustParse(t, "component=default-scheduler", false).Match(event) {
+		t.Errorf("expected component to match reportingController")
+	}
+	if mustParse(t, "component=kubelet", false).Match(event) {
+		t.Errorf("expected reportingController to take precedence over source.component")
+	}
+}
+
+func TestFilterAllow(t *testing.T) {
+	tests := []struct {
+		name     string
+		includes []string
+		excludes []string
+		expected bool
+	}{
+		{name: "no rules", expected: true},
+		{name: "include matches", includes: []string{"type=Warning"}, expected: true},
+		{name: "include does not match", includes: []string{"type=Normal"}, expected: false},
+		{name: "any include of the same field", includes: []string{"namespace=default", "namespace=kube-*"}, expected: true},
+		{name: "all fields must match", includes: []string{"type=Warning", "reason=Failed"}, expected: false},
+		{name: "exclude wins over include", includes: []string{"type=Warning"}, excludes: []string{"reason=BackOff"}, expected: false},
+		{name: "exclude does not match", excludes: []string{"namespace=default"}, expected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rules []*Rule
+			for _, rule := range test.includes {
+				rules = append(rules, mustParse(t, rule, false))
+			}
+			for _, rule := range test.excludes {
+				rules = append(rules, mustParse(t, rule, true))
+			}
+			if got := New(rules...).Allow(testEvent()); got != test.expected {
+				t.Errorf("allow = %v, expected %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestNilFilterAllowsEverything(t *testing.T) {
+	var f *Filter
+	if !f.Allow(testEvent()) {
+		t.Errorf("expected nil filter to allow events")
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/auth"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/elasticsearch"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+)
+
+// authenticate 校验请求中的 bearer token，并将用户保存到 context。未开启认证时直接返回
+func (s *searchK8sEventServer) authenticate(ctx context.Context) (context.Context, error) {
+	if s.auth == nil {
+		return ctx, nil
+	}
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			token = strings.TrimPrefix(values[0], "Bearer ")
+			if token == values[0] {
+				token = ""
+			}
+		}
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "bearer token is required")
+	}
+	user, err := s.auth.Authenticate(ctx, token)
+	if err != nil {
+		if errors.Is(err, auth.ErrUnauthenticated) {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		s.logger.Error(err, "Failed to authenticate request")
+		return nil, status.Error(codes.Unavailable, "failed to authenticate request")
+	}
+	return auth.WithUser(ctx, user), nil
+}
+
+func (s *searchK8sEventServer) authUnaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *searchK8sEventServer) authStreamInterceptor(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticatedStream 返回带有用户信息的 context
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authorizeNamespace 检查调用方能否查看 namespace 中的事件，集群范围对象的事件需要所有 namespace 的权限
+func (s *searchK8sEventServer) authorizeNamespace(ctx context.Context, namespace string) error {
+	user := auth.UserFrom(ctx)
+	if s.auth == nil || user == nil {
+		return nil
+	}
+	allowed, err := s.auth.CanListEvents(ctx, user, namespace)
+	if err != nil {
+		s.logger.Error(err, "Failed to authorize request", "user", user.Name, "namespace", namespace)
+		return status.Error(codes.Unavailable, "failed to authorize request")
+	}
+	if !allowed {
+		if namespace == "" {
+			return status.Errorf(codes.PermissionDenied, "user %q cannot list events in all namespaces", user.Name)
+		}
+		return status.Errorf(codes.PermissionDenied, "user %q cannot list events in namespace %q", user.Name, namespace)
+	}
+	return nil
+}
+
+// authorizeNamespaces 返回调用方可以查看的 namespace，requested 中没有权限的 namespace 被去掉。
+// requested 为空表示所有 namespace，需要所有 namespace 的权限，否则调用方需要指定 namespace；返回 nil 表示不限制
+func (s *searchK8sEventServer) authorizeNamespaces(ctx context.Context, requested []string) ([]string, error) {
+	user := auth.UserFrom(ctx)
+	if s.auth == nil || user == nil {
+		return requested, nil
+	}
+	if len(requested) == 0 {
+		if err := s.authorizeNamespace(ctx, metav1.NamespaceAll); err != nil {
+			if status.Code(err) == codes.PermissionDenied {
+				return nil, status.Errorf(codes.PermissionDenied, "user %q cannot list events in all namespaces, specify the namespaces to query", user.Name)
+			}
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	var allowed []string
+	for _, namespace := range requested {
+		err := s.authorizeNamespace(ctx, namespace)
+		if err == nil {
+			allowed = append(allowed, namespace)
+		} else if status.Code(err) != codes.PermissionDenied {
+			return nil, err
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, status.Errorf(codes.PermissionDenied, "user %q cannot list events in the requested namespaces", user.Name)
+	}
+	return allowed, nil
+}
+
+// authorizedResources 返回调用方可以 list 的对象，工作负载的下属对象由服务端的权限查询，
+// 只返回调用方本身有权限查看的类型
+func (s *searchK8sEventServer) authorizedResources(ctx context.Context, namespace string, refs []elasticsearch.ObjectRef) ([]elasticsearch.ObjectRef, error) {
+	user := auth.UserFrom(ctx)
+	if s.auth == nil || user == nil {
+		return refs, nil
+	}
+	allowed := map[string]bool{}
+	var result []elasticsearch.ObjectRef
+	for _, ref := range refs {
+		ok, checked := allowed[ref.Kind]
+		if !checked {
+			resource, known := workloadResources[ref.Kind]
+			if known {
+				var err error
+				if ok, err = s.auth.CanList(ctx, user, resource.Group, resource.Resource, namespace); err != nil {
+					s.logger.Error(err, "Failed to authorize request", "user", user.Name, "namespace", namespace, "resource", resource.Resource)
+					return nil, status.Error(codes.Unavailable, "failed to authorize request")
+				}
+			}
+			allowed[ref.Kind] = ok
+		}
+		if ok {
+			result = append(result, ref)
+		}
+	}
+	return result, nil
+}
@@ -2,88 +2,356 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/auth"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/broadcast"
 	"github.com/jiangzhiheng/k8s-event-collector/pkg/elasticsearch"
 	eventgrpc "github.com/jiangzhiheng/k8s-event-collector/pkg/grpc"
 	"github.com/jiangzhiheng/k8s-event-collector/pkg/metrics"
-	"github.com/jiangzhiheng/k8s-event-collector/pkg/options"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 	"time"
 )
 
+// Backend 是查询事件的存储端，由 *elasticsearch.ESClient 实现
+type Backend interface {
+	SearchEvents(ctx context.Context, q *elasticsearch.EventQuery) (*elasticsearch.SearchResult, error)
+	SearchWorkloadEvents(ctx context.Context, q *elasticsearch.WorkloadQuery) (*elasticsearch.SearchResult, error)
+	EventStats(ctx context.Context, q *elasticsearch.StatsQuery) (*elasticsearch.StatsResult, error)
+}
+
 type searchK8sEventServer struct {
 	eventgrpc.UnimplementedSearchEventServiceServer
+	backend Backend
+	// 用于查询工作负载的下属对象
+	client      kubernetes.Interface
+	broadcaster *broadcast.Broadcaster
+	// 为 nil 时不认证
+	auth   *auth.Authorizer
+	logger klog.Logger
 }
 
-func (s *searchK8sEventServer) GetResourceEvents(ctx context.Context, req *eventgrpc.DescribeEventRequest) (*eventgrpc.DescribeEventResponse, error) {
-	opts := options.NewOptions()
-	opts.AddFlags()
-	if err := opts.Parse(); err != nil {
-		klog.Fatalf("failed to parse commandline args,err:%s", err.Error())
+func newSearchK8sEventServer(backend Backend, client kubernetes.Interface, broadcaster *broadcast.Broadcaster, authorizer *auth.Authorizer, logger klog.Logger) *searchK8sEventServer {
+	return &searchK8sEventServer{
+		backend:     backend,
+		client:      client,
+		broadcaster: broadcaster,
+		auth:        authorizer,
+		logger:      logger,
 	}
+}
 
-	esClient, err := elasticsearch.NewES(&elasticsearch.ESConfig{
-		Hosts:    opts.ESEndpoint,
-		Username: opts.ESUsername,
-		Password: opts.ESPassword,
-	})
+func (s *searchK8sEventServer) GetResourceEvents(ctx context.Context, req *eventgrpc.DescribeEventRequest) (*eventgrpc.DescribeEventResponse, error) {
+	query, err := eventQuery(req)
 	if err != nil {
-		klog.Errorf("Init elastic connect failed")
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.authorizeNamespace(ctx, req.ResourceNamespace); err != nil {
+		return nil, err
 	}
 
-	eventDocuments, totalCount, err := esClient.SearchEventDocuments(req.ResourceNamespace, req.ResourceType, req.ResourceName)
+	result, err := s.backend.SearchEvents(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, s.backendError(err)
 	}
 
-	events := make([]*eventgrpc.Event, len(eventDocuments))
-	for i, doc := range eventDocuments {
-		events[i] = &eventgrpc.Event{
-			Type:                    doc.Type,
-			Message:                 doc.Message,
-			Reason:                  doc.Reason,
-			Action:                  doc.Action,
-			Name:                    doc.Name,
-			Kind:                    doc.Kind,
-			RelatedName:             doc.RelatedName,
-			RelatedKind:             doc.RelatedKind,
-			RelatedNamespace:        doc.RelatedNamespace,
-			InvolvedObjectNamespace: doc.InvolvedObjectNamespace,
-			InvolvedObjectKind:      doc.InvolvedObjectKind,
-			InvolvedObjectName:      doc.InvolvedObjectName,
-			Count:                   doc.Count,
-		}
+	events := make([]*eventgrpc.Event, len(result.Documents))
+	for i, doc := range result.Documents {
+		events[i] = toEvent(doc)
 	}
 
 	// 增加一次调用成功的指标
 	metrics.AddSearchK8sEventServerTotal(req.ResourceNamespace)
 
 	return &eventgrpc.DescribeEventResponse{
-		Event:      events,
-		TotalCount: uint32(totalCount),
+		Event:         events,
+		TotalCount:    uint32(result.Total),
+		NextPageToken: result.NextPageToken,
 	}, nil
 }
 
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// eventQuery 校验请求并转换为 es 查询条件
+func eventQuery(req *eventgrpc.DescribeEventRequest) (*elasticsearch.EventQuery, error) {
+	q, err := pageQuery(req.Since, req.Until, req.PageSize, req.PageToken, req.SortOrder)
+	if err != nil {
+		return nil, err
+	}
+	q.Filter = elasticsearch.EventFilter{
+		Namespaces: []string{req.ResourceNamespace},
+		Kinds:      []string{req.ResourceType},
+		Names:      []string{req.ResourceName},
+	}
+	return q, nil
+}
+
+// pageQuery 校验时间范围和分页参数
+func pageQuery(since, until *timestamppb.Timestamp, pageSize uint32, pageToken string, order eventgrpc.SortOrder) (*elasticsearch.EventQuery, error) {
+	q := &elasticsearch.EventQuery{
+		PageSize:  int(pageSize),
+		PageToken: pageToken,
+		Ascending: order == eventgrpc.SortOrder_SORT_ORDER_ASC,
+	}
+	if since != nil {
+		if err := since.CheckValid(); err != nil {
+			return nil, fmt.Errorf("invalid since: %v", err)
+		}
+		q.Since = since.AsTime()
+	}
+	if until != nil {
+		if err := until.CheckValid(); err != nil {
+			return nil, fmt.Errorf("invalid until: %v", err)
+		}
+		q.Until = until.AsTime()
+	}
+	if !q.Since.IsZero() && !q.Until.IsZero() && !q.Until.After(q.Since) {
+		return nil, fmt.Errorf("until must be after since")
+	}
+	if q.PageSize == 0 {
+		q.PageSize = defaultPageSize
+	}
+	if q.PageSize > maxPageSize {
+		q.PageSize = maxPageSize
+	}
+	return q, nil
+}
+
+func (s *searchK8sEventServer) SearchEvents(ctx context.Context, req *eventgrpc.SearchEventsRequest) (*eventgrpc.SearchEventsResponse, error) {
+	query, err := pageQuery(req.Since, req.Until, req.PageSize, req.PageToken, req.SortOrder)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if query.Filter, err = eventFilter(req.Filter); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if query.Filter.Namespaces, err = s.authorizeNamespaces(ctx, query.Filter.Namespaces); err != nil {
+		return nil, err
+	}
+
+	result, err := s.backend.SearchEvents(ctx, query)
+	if err != nil {
+		return nil, s.backendError(err)
+	}
+
+	resp := &eventgrpc.SearchEventsResponse{
+		Events:        make([]*eventgrpc.Event, len(result.Documents)),
+		TotalCount:    uint32(result.Total),
+		NextPageToken: result.NextPageToken,
+	}
+	for i, doc := range result.Documents {
+		resp.Events[i] = toEvent(doc)
+	}
+
+	for _, ns := range req.Filter.GetNamespaces() {
+		metrics.AddSearchK8sEventServerTotal(ns)
+	}
+	return resp, nil
+}
+
+// eventFilter 将 grpc 的过滤条件转换为 es 的过滤条件
+func eventFilter(f *eventgrpc.EventFilter) (elasticsearch.EventFilter, error) {
+	if f == nil {
+		return elasticsearch.EventFilter{}, nil
+	}
+	filter := elasticsearch.EventFilter{
+		Namespaces: f.Namespaces,
+		Kinds:      f.Kinds,
+		Names:      f.Names,
+		Type:       f.Type,
+		Reasons:    f.Reasons,
+		Node:       f.Node,
+		Component:  f.ReportingComponent,
+		Message:    f.MessageQuery,
+	}
+	for _, l := range f.Labels {
+		if l.Key == "" {
+			return filter, fmt.Errorf("label matcher key is required")
+		}
+		var op elasticsearch.LabelOperator
+		switch l.Operator {
+		case eventgrpc.LabelMatcher_EQUAL:
+			op = elasticsearch.LabelEqual
+		case eventgrpc.LabelMatcher_NOT_EQUAL:
+			op = elasticsearch.LabelNotEqual
+		case eventgrpc.LabelMatcher_EXISTS:
+			op = elasticsearch.LabelExists
+		case eventgrpc.LabelMatcher_NOT_EXISTS:
+			op = elasticsearch.LabelNotExists
+		default:
+			return filter, fmt.Errorf("unknown label matcher operator %v", l.Operator)
+		}
+		filter.Labels = append(filter.Labels, elasticsearch.LabelMatcher{Key: l.Key, Value: l.Value, Operator: op})
+	}
+	return filter, nil
+}
+
+const (
+	defaultWorkloadEventLimit = 500
+	maxWorkloadEventLimit     = 10000
+)
+
+func (s *searchK8sEventServer) GetWorkloadEvents(ctx context.Context, req *eventgrpc.WorkloadEventRequest) (*eventgrpc.WorkloadEventResponse, error) {
+	if req.Namespace == "" || req.Kind == "" || req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "namespace, kind and name are required")
+	}
+	if !isWorkloadKind(req.Kind) {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported workload kind %q, must be Deployment, StatefulSet, DaemonSet, Job or CronJob", req.Kind)
+	}
+	page, err := pageQuery(req.Since, req.Until, 0, "", eventgrpc.SortOrder_SORT_ORDER_ASC)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultWorkloadEventLimit
+	}
+	if limit > maxWorkloadEventLimit {
+		limit = maxWorkloadEventLimit
+	}
+	if err := s.authorizeNamespace(ctx, req.Namespace); err != nil {
+		return nil, err
+	}
+
+	resources, err := resolveWorkload(ctx, s.client, req.Namespace, req.Kind, req.Name)
+	if err != nil {
+		s.logger.Error(err, "Failed to resolve workload", "namespace", req.Namespace, "kind", req.Kind, "name", req.Name)
+		return nil, status.Errorf(codes.Internal, "failed to resolve workload: %v", err)
+	}
+
+	result, err := s.backend.SearchWorkloadEvents(ctx, &elasticsearch.WorkloadQuery{
+		Namespace: req.Namespace,
+		Workload:  elasticsearch.ObjectRef{Kind: req.Kind, Name: req.Name},
+		Resources: resources,
+		Since:     page.Since,
+		Until:     page.Until,
+		Size:      limit,
+	})
+	if err != nil {
+		return nil, s.backendError(err)
+	}
+
+	resp := &eventgrpc.WorkloadEventResponse{
+		Events:     make([]*eventgrpc.Event, len(result.Documents)),
+		TotalCount: uint32(result.Total),
+		Truncated:  result.Total > int64(len(result.Documents)),
+	}
+	for i, doc := range result.Documents {
+		resp.Events[i] = toEvent(doc)
+	}
+	// 下属对象用于查询事件，但只返回调用方有权限查看的
+	visible, err := s.authorizedResources(ctx, req.Namespace, resources)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range visible {
+		resp.Resources = append(resp.Resources, &eventgrpc.ObjectReference{Kind: r.Kind, Name: r.Name})
+	}
+
+	metrics.AddSearchK8sEventServerTotal(req.Namespace)
+	return resp, nil
+}
+
+// backendError 记录存储端的错误，返回给客户端 Internal
+func (s *searchK8sEventServer) backendError(err error) error {
+	s.logger.Error(err, "Failed to query events")
+	return status.Errorf(codes.Internal, "failed to query events: %v", err)
+}
+
+// toEvent 将 es 文档转换为 grpc 返回的 Event
+func toEvent(doc *elasticsearch.EventDocument) *eventgrpc.Event {
+	return &eventgrpc.Event{
+		Type:                     doc.Type,
+		Message:                  doc.Message,
+		Reason:                   doc.Reason,
+		Action:                   doc.Action,
+		Name:                     doc.Name,
+		Kind:                     doc.Kind,
+		RelatedName:              doc.RelatedName,
+		RelatedKind:              doc.RelatedKind,
+		RelatedNamespace:         doc.RelatedNamespace,
+		InvolvedObjectNamespace:  doc.InvolvedObjectNamespace,
+		InvolvedObjectKind:       doc.InvolvedObjectKind,
+		InvolvedObjectName:       doc.InvolvedObjectName,
+		InvolvedObjectUid:        doc.InvolvedObjectUID,
+		InvolvedObjectApiVersion: doc.InvolvedObjectAPIVersion,
+		InvolvedObjectFieldPath:  doc.InvolvedObjectFieldPath,
+		SourceComponent:          doc.SourceComponent,
+		SourceHost:               doc.SourceHost,
+		ReportingController:      doc.ReportingController,
+		ReportingInstance:        doc.ReportingInstance,
+		EventTime:                toTimestamp(doc.EventTime),
+		MicroEventTime:           toTimestamp(doc.MicroEventTime),
+		FirstTimestamp:           toTimestamp(doc.FirstTimestamp),
+		LastTimestamp:            toTimestamp(doc.LastTimestamp),
+		Count:                    doc.Count,
+		SeriesCount:              doc.SeriesCount,
+		SeriesLastObservedTime:   toTimestamp(doc.SeriesLastObservedTime),
+		Labels:                   doc.Labels,
+		Timestamp:                toTimestamp(doc.Timestamp),
+		ObjectLabels:             doc.ObjectLabels,
+		ObjectAnnotations:        doc.ObjectAnnotations,
+		OwnerChain:               doc.OwnerChain,
+		WorkloadKind:             doc.WorkloadKind,
+		WorkloadName:             doc.WorkloadName,
+		NodeName:                 doc.NodeName,
+		ContainerImages:          doc.ContainerImages,
+	}
+}
+
+// toTimestamp 零值时间返回 nil，避免客户端收到 1970 年的时间
+func toTimestamp(t v1.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t.Time)
+}
+
 // 实现 unary interceptors
-func eventUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+func (s *searchK8sEventServer) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	// Pre-processing logic
-	s := time.Now()
+	start := time.Now()
 
 	// 获取 RequestID
-	md, ok := metadata.FromIncomingContext(ctx)
-	var RequestID string
-	if ok {
-		RequestID = md.Get("RequestID")[0]
-	} else {
-
+	var requestID string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("RequestID"); len(values) > 0 {
+			requestID = values[0]
+		}
 	}
 	// 可以在这里对 req 进行校验或者修改
 	m, err := handler(ctx, req)
 
 	// Post processing logic
-	klog.Infof("Method: %s, req: %s, resp: %s, latency: %s, RequestID:%s\n",
-		info.FullMethod, req, m, time.Now().Sub(s), RequestID)
+	// 响应最多有上万个事件，只在 V(4) 记录完整的请求和响应
+	s.logger.Info("Handled request", "method", info.FullMethod, "code", status.Code(err), "latency", time.Since(start), "results", resultCount(m), "requestID", requestID, "err", err)
+	if logger := s.logger.V(4); logger.Enabled() {
+		logger.Info("Request payload", "method", info.FullMethod, "requestID", requestID, "req", req, "resp", m)
+	}
 
 	return m, err
 }
+
+// resultCount 返回响应中的事件或统计桶数量
+func resultCount(resp interface{}) int {
+	switch r := resp.(type) {
+	case *eventgrpc.DescribeEventResponse:
+		return len(r.Event)
+	case *eventgrpc.WorkloadEventResponse:
+		return len(r.Events)
+	case *eventgrpc.SearchEventsResponse:
+		return len(r.Events)
+	case *eventgrpc.EventStatsResponse:
+		return len(r.Buckets)
+	}
+	return 0
+}
@@ -0,0 +1,462 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/auth"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/elasticsearch"
+	eventgrpc "github.com/jiangzhiheng/k8s-event-collector/pkg/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/klog/v2"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeBackend 记录收到的查询并返回预设的结果
+type fakeBackend struct {
+	result *elasticsearch.SearchResult
+	stats  *elasticsearch.StatsResult
+	err    error
+
+	query         *elasticsearch.EventQuery
+	workloadQuery *elasticsearch.WorkloadQuery
+	statsQuery    *elasticsearch.StatsQuery
+}
+
+func (f *fakeBackend) SearchEvents(_ context.Context, q *elasticsearch.EventQuery) (*elasticsearch.SearchResult, error) {
+	f.query = q
+	return f.result, f.err
+}
+
+func (f *fakeBackend) SearchWorkloadEvents(_ context.Context, q *elasticsearch.WorkloadQuery) (*elasticsearch.SearchResult, error) {
+	f.workloadQuery = q
+	return f.result, f.err
+}
+
+func (f *fakeBackend) EventStats(_ context.Context, q *elasticsearch.StatsQuery) (*elasticsearch.StatsResult, error) {
+	f.statsQuery = q
+	return f.stats, f.err
+}
+
+func newTestServer(backend Backend, objects ...runtime.Object) *searchK8sEventServer {
+	return newSearchK8sEventServer(backend, fake.NewSimpleClientset(objects...), nil, nil, klog.Background())
+}
+
+func testDocument(name string) *elasticsearch.EventDocument {
+	return &elasticsearch.EventDocument{
+		Name:                    name,
+		Type:                    v1api.EventTypeWarning,
+		Reason:                  "BackOff",
+		InvolvedObjectNamespace: "payments",
+		InvolvedObjectKind:      "Pod",
+		InvolvedObjectName:      "api-0",
+		Count:                   3,
+		Timestamp:               metav1.NewTime(time.Unix(1700000000, 0)),
+	}
+}
+
+func TestGetResourceEvents(t *testing.T) {
+	backend := &fakeBackend{result: &elasticsearch.SearchResult{
+		Documents:     []*elasticsearch.EventDocument{testDocument("api-0.1"), testDocument("api-0.2")},
+		Total:         5,
+		NextPageToken: "next",
+	}}
+	s := newTestServer(backend)
+
+	since := time.Unix(1700000000, 0).UTC()
+	resp, err := s.GetResourceEvents(context.Background(), &eventgrpc.DescribeEventRequest{
+		ResourceNamespace: "payments",
+		ResourceType:      "Pod",
+		ResourceName:      "api-0",
+		Since:             timestamppb.New(since),
+		SortOrder:         eventgrpc.SortOrder_SORT_ORDER_ASC,
+	})
+	if err != nil {
+		t.Fatalf("GetResourceEvents failed: %v", err)
+	}
+
+	q := backend.query
+	if !reflect.DeepEqual(q.Filter, elasticsearch.EventFilter{
+		Namespaces: []string{"payments"},
+		Kinds:      []string{"Pod"},
+		Names:      []string{"api-0"},
+	}) {
+		t.Errorf("unexpected filter: %+v", q.Filter)
+	}
+	if !q.Since.Equal(since) || !q.Until.IsZero() || !q.Ascending || q.PageSize != defaultPageSize {
+		t.Errorf("unexpected query: %+v", q)
+	}
+	if len(resp.Event) != 2 || resp.TotalCount != 5 || resp.NextPageToken != "next" {
+		t.Errorf("unexpected response: %v", resp)
+	}
+	if resp.Event[0].Name != "api-0.1" || resp.Event[0].Count != 3 || resp.Event[0].FirstTimestamp != nil {
+		t.Errorf("unexpected event: %v", resp.Event[0])
+	}
+}
+
+func TestGetResourceEventsInvalidArgument(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		req  *eventgrpc.DescribeEventRequest
+	}{
+		{"until before since", &eventgrpc.DescribeEventRequest{
+			Since: timestamppb.New(now),
+			Until: timestamppb.New(now.Add(-time.Minute)),
+		}},
+		{"invalid since", &eventgrpc.DescribeEventRequest{
+			Since: &timestamppb.Timestamp{Nanos: -1},
+		}},
+	}
+	for _, test := range tests {
+		backend := &fakeBackend{}
+		_, err := newTestServer(backend).GetResourceEvents(context.Background(), test.req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got %v", test.name, err)
+		}
+		if backend.query != nil {
+			t.Errorf("%s: backend should not be queried", test.name)
+		}
+	}
+}
+
+func TestPageSizeLimit(t *testing.T) {
+	backend := &fakeBackend{result: &elasticsearch.SearchResult{}}
+	_, err := newTestServer(backend).GetResourceEvents(context.Background(), &eventgrpc.DescribeEventRequest{PageSize: 100000})
+	if err != nil {
+		t.Fatalf("GetResourceEvents failed: %v", err)
+	}
+	if backend.query.PageSize != maxPageSize {
+		t.Errorf("expected page size %d, got %d", maxPageSize, backend.query.PageSize)
+	}
+}
+
+func TestBackendError(t *testing.T) {
+	backend := &fakeBackend{err: errors.New("connection refused")}
+	_, err := newTestServer(backend).SearchEvents(context.Background(), &eventgrpc.SearchEventsRequest{})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("expected Internal, got %v", err)
+	}
+}
+
+func TestSearchEventsFilter(t *testing.T) {
+	backend := &fakeBackend{result: &elasticsearch.SearchResult{}}
+	_, err := newTestServer(backend).SearchEvents(context.Background(), &eventgrpc.SearchEventsRequest{
+		Filter: &eventgrpc.EventFilter{
+			Namespaces:         []string{"payments"},
+			Type:               v1api.EventTypeWarning,
+			Reasons:            []string{"BackOff"},
+			Node:               "node-1",
+			ReportingComponent: "kubelet",
+			MessageQuery:       "image pull",
+			Labels: []*eventgrpc.LabelMatcher{
+				{Key: "app", Value: "api"},
+				{Key: "canary", Operator: eventgrpc.LabelMatcher_NOT_EXISTS},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("SearchEvents failed: %v", err)
+	}
+	expected := elasticsearch.EventFilter{
+		Namespaces: []string{"payments"},
+		Type:       v1api.EventTypeWarning,
+		Reasons:    []string{"BackOff"},
+		Node:       "node-1",
+		Component:  "kubelet",
+		Message:    "image pull",
+		Labels: []elasticsearch.LabelMatcher{
+			{Key: "app", Value: "api", Operator: elasticsearch.LabelEqual},
+			{Key: "canary", Operator: elasticsearch.LabelNotExists},
+		},
+	}
+	if !reflect.DeepEqual(backend.query.Filter, expected) {
+		t.Errorf("unexpected filter: %+v", backend.query.Filter)
+	}
+
+	_, err = newTestServer(backend).SearchEvents(context.Background(), &eventgrpc.SearchEventsRequest{
+		Filter: &eventgrpc.EventFilter{Labels: []*eventgrpc.LabelMatcher{{Value: "api"}}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for label matcher without key, got %v", err)
+	}
+}
+
+func TestGetWorkloadEvents(t *testing.T) {
+	controller := true
+	deploy := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "payments", Name: "api", UID: "deploy"}}
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "payments", Name: "api-7d9c", UID: "rs",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "api", UID: "deploy", Controller: &controller}},
+	}}
+	pod := &v1api.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "payments", Name: "api-7d9c-x1", UID: "pod",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "api-7d9c", UID: "rs", Controller: &controller}},
+	}}
+	other := &v1api.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "payments", Name: "other", UID: "other"}}
+
+	backend := &fakeBackend{result: &elasticsearch.SearchResult{
+		Documents: []*elasticsearch.EventDocument{testDocument("api-0.1")},
+		Total:     3,
+	}}
+	since := time.Date(2024, 4, 12, 0, 0, 0, 0, time.UTC)
+	resp, err := newTestServer(backend, deploy, rs, pod, other).GetWorkloadEvents(context.Background(), &eventgrpc.WorkloadEventRequest{
+		Namespace: "payments",
+		Kind:      "Deployment",
+		Name:      "api",
+		Since:     timestamppb.New(since),
+	})
+	if err != nil {
+		t.Fatalf("GetWorkloadEvents failed: %v", err)
+	}
+
+	q := backend.workloadQuery
+	expected := []elasticsearch.ObjectRef{{Kind: "ReplicaSet", Name: "api-7d9c"}, {Kind: "Pod", Name: "api-7d9c-x1"}}
+	if !reflect.DeepEqual(q.Resources, expected) {
+		t.Errorf("unexpected resources: %v", q.Resources)
+	}
+	if q.Workload != (elasticsearch.ObjectRef{Kind: "Deployment", Name: "api"}) || q.Size != defaultWorkloadEventLimit || !q.Since.Equal(since) {
+		t.Errorf("unexpected workload query: %+v", q)
+	}
+	// 匹配的事件比返回的多，需要告诉调用方结果被截断
+	if len(resp.Events) != 1 || len(resp.Resources) != 2 || !resp.Truncated {
+		t.Errorf("unexpected response: %v", resp)
+	}
+
+	_, err = newTestServer(backend).GetWorkloadEvents(context.Background(), &eventgrpc.WorkloadEventRequest{
+		Namespace: "payments",
+		Kind:      "Pod",
+		Name:      "api-0",
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for unsupported kind, got %v", err)
+	}
+}
+
+func TestGetWorkloadEventsHidesUnauthorizedResources(t *testing.T) {
+	controller := true
+	deploy := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "payments", Name: "api", UID: "deploy"}}
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "payments", Name: "api-7d9c", UID: "rs",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "api", UID: "deploy", Controller: &controller}},
+	}}
+	pod := &v1api.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "payments", Name: "api-7d9c-x1", UID: "pod",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "api-7d9c", UID: "rs", Controller: &controller}},
+	}}
+	backend := &fakeBackend{result: &elasticsearch.SearchResult{}}
+	s, _ := newAuthTestServer(backend, deploy, rs, pod)
+	ctx, err := s.authenticate(withToken("valid"))
+	if err != nil {
+		t.Fatalf("authenticate failed: %v", err)
+	}
+
+	resp, err := s.GetWorkloadEvents(ctx, &eventgrpc.WorkloadEventRequest{Namespace: "payments", Kind: "Deployment", Name: "api"})
+	if err != nil {
+		t.Fatalf("GetWorkloadEvents failed: %v", err)
+	}
+	// 所有下属对象都用于查询事件，但只返回调用方可以 list 的 Pod
+	if len(backend.workloadQuery.Resources) != 2 {
+		t.Errorf("expected all resources to be queried, got %v", backend.workloadQuery.Resources)
+	}
+	if len(resp.Resources) != 1 || resp.Resources[0].Kind != "Pod" || resp.Resources[0].Name != "api-7d9c-x1" {
+		t.Errorf("expected only the pod to be returned, got %v", resp.Resources)
+	}
+}
+
+func TestGetEventStats(t *testing.T) {
+	backend := &fakeBackend{stats: &elasticsearch.StatsResult{
+		Buckets: []elasticsearch.StatsBucket{
+			{Keys: []string{"payments", "BackOff"}, Value: 20},
+			{Keys: []string{"payments", "Failed"}, Time: time.Unix(1700000000, 0), Value: 3},
+		},
+		Total: 23,
+	}}
+	resp, err := newTestServer(backend).GetEventStats(context.Background(), &eventgrpc.EventStatsRequest{
+		GroupBy:  []eventgrpc.EventStatsRequest_Dimension{eventgrpc.EventStatsRequest_NAMESPACE, eventgrpc.EventStatsRequest_REASON},
+		Interval: durationpb.New(time.Hour),
+		Size:     20,
+		Metric:   eventgrpc.EventStatsRequest_OCCURRENCES,
+	})
+	if err != nil {
+		t.Fatalf("GetEventStats failed: %v", err)
+	}
+	q := backend.statsQuery
+	if !reflect.DeepEqual(q.GroupBy, []elasticsearch.Dimension{elasticsearch.DimensionNamespace, elasticsearch.DimensionReason}) ||
+		q.Interval != time.Hour || q.Size != 20 || !q.SumCount {
+		t.Errorf("unexpected stats query: %+v", q)
+	}
+	if len(resp.Buckets) != 2 || resp.TotalCount != 23 || resp.Buckets[0].Time != nil || resp.Buckets[1].Time == nil {
+		t.Errorf("unexpected response: %v", resp)
+	}
+
+	tests := []struct {
+		name string
+		req  *eventgrpc.EventStatsRequest
+	}{
+		{"no group by or interval", &eventgrpc.EventStatsRequest{}},
+		{"unspecified dimension", &eventgrpc.EventStatsRequest{
+			GroupBy: []eventgrpc.EventStatsRequest_Dimension{eventgrpc.EventStatsRequest_DIMENSION_UNSPECIFIED},
+		}},
+		{"sub-second interval", &eventgrpc.EventStatsRequest{Interval: durationpb.New(time.Millisecond)}},
+	}
+	for _, test := range tests {
+		_, err := newTestServer(&fakeBackend{}).GetEventStats(context.Background(), test.req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got %v", test.name, err)
+		}
+	}
+}
+
+// fakeWatchStream 记录 WatchEvents 发送的事件
+type fakeWatchStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent []*eventgrpc.WatchEventsResponse
+}
+
+func (f *fakeWatchStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeWatchStream) Send(resp *eventgrpc.WatchEventsResponse) error {
+	f.sent = append(f.sent, resp)
+	return nil
+}
+
+func TestWatchEventsPollsWithoutCollector(t *testing.T) {
+	interval := watchPollInterval
+	watchPollInterval = 10 * time.Millisecond
+	defer func() { watchPollInterval = interval }()
+
+	first, second := testDocument("first"), testDocument("second")
+	first.Timestamp, second.Timestamp = metav1.Now(), metav1.Now()
+	backend := &fakeBackend{result: &elasticsearch.SearchResult{Documents: []*elasticsearch.EventDocument{first, second}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &fakeWatchStream{ctx: ctx}
+	start := time.Now()
+	done := make(chan error)
+	go func() {
+		done <- newTestServer(backend).WatchEvents(&eventgrpc.WatchEventsRequest{}, stream)
+	}()
+	// 等待多轮轮询，同一个事件只发送一次
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-done; status.Code(err) != codes.Canceled {
+		t.Errorf("expected Canceled, got %v", err)
+	}
+	if len(stream.sent) != 2 || stream.sent[0].Event.Name != "first" || stream.sent[1].Event.Name != "second" {
+		t.Fatalf("expected each polled event to be sent once, got %v", stream.sent)
+	}
+	if stream.sent[0].Backfill {
+		t.Errorf("expected polled events not to be marked as backfill")
+	}
+	if !backend.query.Ascending || backend.query.Since.Before(start) {
+		t.Errorf("expected to poll events since the watch started in ascending order, got %+v", backend.query)
+	}
+}
+
+// newAuthTestServer 返回开启认证的服务，token "valid" 对应的用户只能查看 payments 中的事件和 Pod
+func newAuthTestServer(backend Backend, objects ...runtime.Object) (*searchK8sEventServer, *int) {
+	client := fake.NewSimpleClientset(objects...)
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "valid" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: "alice", Groups: []string{"dev"}}
+		}
+		return true, review, nil
+	})
+	reviews := 0
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = review.Spec.User == "alice" && attrs.Namespace == "payments" &&
+			attrs.Verb == "list" && attrs.Group == "" && (attrs.Resource == "events" || attrs.Resource == "pods")
+		return true, review, nil
+	})
+	authorizer := auth.New(client, &auth.Config{Enabled: true, CacheTTL: time.Minute})
+	return newSearchK8sEventServer(backend, client, nil, authorizer, klog.Background()), &reviews
+}
+
+func withToken(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func TestAuthentication(t *testing.T) {
+	s, _ := newAuthTestServer(&fakeBackend{result: &elasticsearch.SearchResult{}})
+	tests := []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{"no token", context.Background(), codes.Unauthenticated},
+		{"invalid token", withToken("invalid"), codes.Unauthenticated},
+		{"valid token", withToken("valid"), codes.OK},
+	}
+	req := &eventgrpc.SearchEventsRequest{Filter: &eventgrpc.EventFilter{Namespaces: []string{"payments"}}}
+	for _, test := range tests {
+		_, err := s.authUnaryInterceptor(test.ctx, req, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return s.SearchEvents(ctx, req.(*eventgrpc.SearchEventsRequest))
+		})
+		if status.Code(err) != test.code {
+			t.Errorf("%s: expected %v, got %v", test.name, test.code, err)
+		}
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	backend := &fakeBackend{result: &elasticsearch.SearchResult{}}
+	s, reviews := newAuthTestServer(backend)
+	ctx, err := s.authenticate(withToken("valid"))
+	if err != nil {
+		t.Fatalf("authenticate failed: %v", err)
+	}
+
+	// 没有所有 namespace 的权限时需要指定 namespace
+	if _, err := s.SearchEvents(ctx, &eventgrpc.SearchEventsRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied without namespaces, got %v", err)
+	}
+
+	_, err = s.SearchEvents(ctx, &eventgrpc.SearchEventsRequest{
+		Filter: &eventgrpc.EventFilter{Namespaces: []string{"payments", "kube-system"}},
+	})
+	if err != nil {
+		t.Fatalf("SearchEvents failed: %v", err)
+	}
+	if !reflect.DeepEqual(backend.query.Filter.Namespaces, []string{"payments"}) {
+		t.Errorf("expected kube-system to be filtered out, got %v", backend.query.Filter.Namespaces)
+	}
+
+	_, err = s.GetResourceEvents(ctx, &eventgrpc.DescribeEventRequest{ResourceNamespace: "kube-system"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied for kube-system, got %v", err)
+	}
+	_, err = s.GetEventStats(ctx, &eventgrpc.EventStatsRequest{
+		Filter:  &eventgrpc.EventFilter{Namespaces: []string{"kube-system"}},
+		GroupBy: []eventgrpc.EventStatsRequest_Dimension{eventgrpc.EventStatsRequest_REASON},
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied for stats in kube-system, got %v", err)
+	}
+
+	// 所有 namespace 和 payments、kube-system 各检查一次，之后使用缓存
+	if *reviews != 3 {
+		t.Errorf("expected 3 access reviews, got %d", *reviews)
+	}
+}
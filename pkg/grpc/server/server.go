@@ -1,44 +1,121 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/auth"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/broadcast"
 	eventgrpc "github.com/jiangzhiheng/k8s-event-collector/pkg/grpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 	"net"
-	"os"
-	"os/signal"
+	"time"
 )
 
-const GRPCServerPort = 8112
+// 优雅关闭的最长等待时间，WatchEvents 等长连接超时后被强制关闭
+const shutdownTimeout = 10 * time.Second
 
-var server = &searchK8sEventServer{}
+type Config struct {
+	// 监听地址，例如 :8112
+	Address string
+	// 设置证书后使用 TLS，再设置 ClientCAFile 时要求客户端证书（mTLS）。证书文件变化后自动重新加载
+	TLSCertFile  string
+	TLSKeyFile   string
+	ClientCAFile string
+	// 收发消息的最大字节数
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+	// 连接空闲 KeepaliveTime 后发送 ping，KeepaliveTimeout 内未响应则关闭连接
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// 客户端发送 ping 的最小间隔，更频繁的客户端会被断开
+	KeepaliveMinTime time.Duration
+}
+
+// Server 是事件查询的 grpc 服务，依赖由调用方注入，与 collector 共用 es 和 kubernetes 客户端
+type Server struct {
+	cfg     *Config
+	service *searchK8sEventServer
+	logger  klog.Logger
+}
+
+// NewServer 创建 grpc 服务，broadcaster 为 nil 时 WatchEvents 不可用，authorizer 为 nil 时不认证
+func NewServer(cfg *Config, backend Backend, client kubernetes.Interface, broadcaster *broadcast.Broadcaster, authorizer *auth.Authorizer, logger klog.Logger) *Server {
+	return &Server{
+		cfg:     cfg,
+		service: newSearchK8sEventServer(backend, client, broadcaster, authorizer, logger),
+		logger:  logger,
+	}
+}
+
+func (s *Server) serverOptions() ([]grpc.ServerOption, error) {
+	opts := []grpc.ServerOption{
+		// 先记录日志再认证，认证失败的请求也会被记录
+		grpc.ChainUnaryInterceptor(s.service.unaryInterceptor, s.service.authUnaryInterceptor),
+		grpc.StreamInterceptor(s.service.authStreamInterceptor),
+		grpc.MaxRecvMsgSize(s.cfg.MaxRecvMsgSize),
+		grpc.MaxSendMsgSize(s.cfg.MaxSendMsgSize),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    s.cfg.KeepaliveTime,
+			Timeout: s.cfg.KeepaliveTimeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             s.cfg.KeepaliveMinTime,
+			PermitWithoutStream: true,
+		}),
+	}
+	if s.cfg.TLSCertFile != "" {
+		reloader, err := newCertReloader(s.cfg, s.logger)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(reloader.tlsConfig())))
+	}
+	return opts, nil
+}
 
-func Run() {
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", GRPCServerPort))
+// Run 启动 grpc 服务，ctx 结束后优雅关闭
+func (s *Server) Run(ctx context.Context) error {
+	opts, err := s.serverOptions()
 	if err != nil {
-		klog.Fatalf("failed to listen: %v", err)
+		return fmt.Errorf("failed to init grpc server: %v", err)
+	}
+	lis, err := net.Listen("tcp", s.cfg.Address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.cfg.Address, err)
 	}
 
-	s := grpc.NewServer(
-		grpc.UnaryInterceptor(eventUnaryServerInterceptor),
-	)
+	gs := grpc.NewServer(opts...)
 	// 注册服务到 grpc
-	eventgrpc.RegisterSearchEventServiceServer(s, server)
+	eventgrpc.RegisterSearchEventServiceServer(gs, s.service)
 
-	klog.Info("start grpc server...")
+	s.logger.Info("start grpc server...", "address", s.cfg.Address, "tls", s.cfg.TLSCertFile != "", "mtls", s.cfg.ClientCAFile != "")
+	errCh := make(chan error, 1)
 	go func() {
-		if err := s.Serve(lis); err != nil {
-			klog.Fatalf("failed to serve: %v", err)
-		}
+		errCh <- gs.Serve(lis)
 	}()
 
-	// 等待中断信号，优雅地关闭服务器
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("grpc server failed: %v", err)
+	case <-ctx.Done():
+	}
 
 	// 关闭服务器
-	s.GracefulStop()
-	klog.Info("grpc server stopped")
+	stopped := make(chan struct{})
+	go func() {
+		gs.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		s.logger.Info("grpc server graceful stop timed out, closing remaining connections")
+		gs.Stop()
+	}
+	s.logger.Info("grpc server stopped")
+	return nil
 }
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/elasticsearch"
+	eventgrpc "github.com/jiangzhiheng/k8s-event-collector/pkg/grpc"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/metrics"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+const (
+	defaultStatsSize = 10
+	maxStatsSize     = 100
+	maxStatsGroupBy  = 3
+)
+
+var statsDimensions = map[eventgrpc.EventStatsRequest_Dimension]elasticsearch.Dimension{
+	eventgrpc.EventStatsRequest_NAMESPACE: elasticsearch.DimensionNamespace,
+	eventgrpc.EventStatsRequest_KIND:      elasticsearch.DimensionKind,
+	eventgrpc.EventStatsRequest_NAME:      elasticsearch.DimensionName,
+	eventgrpc.EventStatsRequest_REASON:    elasticsearch.DimensionReason,
+	eventgrpc.EventStatsRequest_TYPE:      elasticsearch.DimensionType,
+	eventgrpc.EventStatsRequest_NODE:      elasticsearch.DimensionNode,
+	eventgrpc.EventStatsRequest_COMPONENT: elasticsearch.DimensionComponent,
+	eventgrpc.EventStatsRequest_WORKLOAD:  elasticsearch.DimensionWorkload,
+}
+
+func (s *searchK8sEventServer) GetEventStats(ctx context.Context, req *eventgrpc.EventStatsRequest) (*eventgrpc.EventStatsResponse, error) {
+	query, err := statsQuery(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if query.Filter.Namespaces, err = s.authorizeNamespaces(ctx, query.Filter.Namespaces); err != nil {
+		return nil, err
+	}
+
+	result, err := s.backend.EventStats(ctx, query)
+	if err != nil {
+		return nil, s.backendError(err)
+	}
+
+	resp := &eventgrpc.EventStatsResponse{
+		Buckets:    make([]*eventgrpc.StatsBucket, len(result.Buckets)),
+		TotalCount: uint64(result.Total),
+	}
+	for i, b := range result.Buckets {
+		bucket := &eventgrpc.StatsBucket{Keys: b.Keys, Value: uint64(b.Value)}
+		if !b.Time.IsZero() {
+			bucket.Time = timestamppb.New(b.Time)
+		}
+		resp.Buckets[i] = bucket
+	}
+
+	for _, ns := range req.Filter.GetNamespaces() {
+		metrics.AddSearchK8sEventServerTotal(ns)
+	}
+	return resp, nil
+}
+
+// statsQuery 校验请求并转换为 es 统计条件
+func statsQuery(req *eventgrpc.EventStatsRequest) (*elasticsearch.StatsQuery, error) {
+	page, err := pageQuery(req.Since, req.Until, 0, "", eventgrpc.SortOrder_SORT_ORDER_DESC)
+	if err != nil {
+		return nil, err
+	}
+	q := &elasticsearch.StatsQuery{
+		Since:    page.Since,
+		Until:    page.Until,
+		Size:     int(req.Size),
+		SumCount: req.Metric == eventgrpc.EventStatsRequest_OCCURRENCES,
+	}
+	if q.Filter, err = eventFilter(req.Filter); err != nil {
+		return nil, err
+	}
+
+	if len(req.GroupBy) > maxStatsGroupBy {
+		return nil, fmt.Errorf("at most %d group_by dimensions are supported", maxStatsGroupBy)
+	}
+	for _, d := range req.GroupBy {
+		dimension, ok := statsDimensions[d]
+		if !ok {
+			return nil, fmt.Errorf("unsupported group_by dimension %v", d)
+		}
+		q.GroupBy = append(q.GroupBy, dimension)
+	}
+
+	if req.Interval != nil {
+		if err := req.Interval.CheckValid(); err != nil {
+			return nil, fmt.Errorf("invalid interval: %v", err)
+		}
+		q.Interval = req.Interval.AsDuration()
+		if q.Interval < time.Second || q.Interval%time.Second != 0 {
+			return nil, fmt.Errorf("interval must be a whole number of seconds")
+		}
+	}
+	if len(q.GroupBy) == 0 && q.Interval == 0 {
+		return nil, fmt.Errorf("group_by or interval is required")
+	}
+
+	if q.Size == 0 {
+		q.Size = defaultStatsSize
+	}
+	if q.Size > maxStatsSize {
+		q.Size = maxStatsSize
+	}
+	return q, nil
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"k8s.io/klog/v2"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader 在握手时检查证书文件的修改时间，文件变化后重新加载，
+// 挂载的 Secret 更新后不需要重启进程
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	logger   klog.Logger
+
+	locker  sync.Mutex
+	modTime time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func newCertReloader(cfg *Config, logger klog.Logger) (*certReloader, error) {
+	r := &certReloader{
+		certFile: cfg.TLSCertFile,
+		keyFile:  cfg.TLSKeyFile,
+		caFile:   cfg.ClientCAFile,
+		logger:   logger,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// tlsConfig 返回服务端的 TLS 配置，配置了 client CA 时要求并校验客户端证书
+func (r *certReloader) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+	if r.caFile == "" {
+		return base
+	}
+	// 每次握手使用最新的 CA。GetConfigForClient 返回的配置会替换外层配置，
+	// 需要自己声明 grpc 要求的 ALPN 协议 h2
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   []string{"h2"},
+				Certificates: []tls.Certificate{*cert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    pool,
+			}, nil
+		},
+	}
+}
+
+// current 返回当前的证书和 CA，文件有变化时先重新加载，加载失败时继续使用旧的
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	if modTime, err := r.latestModTime(); err == nil && !modTime.Equal(r.loadedModTime()) {
+		if err := r.reload(); err != nil {
+			r.logger.Error(err, "Failed to reload grpc tls certificates, keep using the old ones")
+		} else {
+			r.logger.Info("Reloaded grpc tls certificates")
+		}
+	}
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	return r.cert, r.pool
+}
+
+func (r *certReloader) loadedModTime() time.Time {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	return r.modTime
+}
+
+// latestModTime 返回证书文件中最新的修改时间
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load grpc certificate: %v", err)
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		ca, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read grpc client CA: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificate found in grpc client CA %s", r.caFile)
+		}
+	}
+
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.cert, r.pool, r.modTime = &cert, pool, modTime
+	return nil
+}
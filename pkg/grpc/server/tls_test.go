@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/elasticsearch"
+	eventgrpc "github.com/jiangzhiheng/k8s-event-collector/pkg/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"k8s.io/klog/v2"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA 签发测试用的服务端和客户端证书
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create ca failed: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue 签发证书，返回证书和私钥的 PEM
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create certificate failed: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key failed: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("write %s failed: %v", path, err)
+	}
+}
+
+func TestMutualTLSNegotiatesHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, "client", x509.ExtKeyUsageClientAuth)
+	cfg := &Config{
+		TLSCertFile:  filepath.Join(dir, "tls.crt"),
+		TLSKeyFile:   filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	writeFile(t, cfg.TLSCertFile, serverCert)
+	writeFile(t, cfg.TLSKeyFile, serverKey)
+	writeFile(t, cfg.ClientCAFile, ca.pem)
+
+	reloader, err := newCertReloader(cfg, klog.Background())
+	if err != nil {
+		t.Fatalf("load certificates failed: %v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	gs := grpc.NewServer(grpc.Creds(credentials.NewTLS(reloader.tlsConfig())))
+	eventgrpc.RegisterSearchEventServiceServer(gs, newTestServer(&fakeBackend{result: &elasticsearch.SearchResult{}}))
+	go gs.Serve(lis)
+	defer gs.Stop()
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+	pair, err := tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatalf("load client certificate failed: %v", err)
+	}
+	dial := func(certs []tls.Certificate) *grpc.ClientConn {
+		creds := credentials.NewTLS(&tls.Config{ServerName: "localhost", RootCAs: pool, Certificates: certs})
+		conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(creds))
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		return conn
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := dial([]tls.Certificate{pair})
+	defer conn.Close()
+	var p peer.Peer
+	if _, err := eventgrpc.NewSearchEventServiceClient(conn).SearchEvents(ctx, &eventgrpc.SearchEventsRequest{}, grpc.Peer(&p)); err != nil {
+		t.Fatalf("SearchEvents with client certificate failed: %v", err)
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		t.Fatalf("expected tls auth info, got %T", p.AuthInfo)
+	}
+	if info.State.NegotiatedProtocol != "h2" {
+		t.Errorf("expected ALPN to negotiate h2, got %q", info.State.NegotiatedProtocol)
+	}
+
+	// 没有客户端证书时握手失败
+	anonymous := dial(nil)
+	defer anonymous.Close()
+	if _, err := eventgrpc.NewSearchEventServiceClient(anonymous).SearchEvents(ctx, &eventgrpc.SearchEventsRequest{}); err == nil {
+		t.Errorf("expected SearchEvents without client certificate to fail")
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/broadcast"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/elasticsearch"
+	eventgrpc "github.com/jiangzhiheng/k8s-event-collector/pkg/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// 补发历史事件的上限
+const maxBackfillEvents = 10000
+
+// 非 leader 副本轮询 es 的间隔和每次回看的时间窗口。事件经过批量写入和索引刷新后才能查到，
+// 回看窗口需要覆盖这段延迟
+var (
+	watchPollInterval = 5 * time.Second
+	watchPollLookback = 2 * time.Minute
+)
+
+func (s *searchK8sEventServer) WatchEvents(req *eventgrpc.WatchEventsRequest, stream eventgrpc.SearchEventService_WatchEventsServer) error {
+	filter, err := eventFilter(req.Filter)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if filter.Namespaces, err = s.authorizeNamespaces(stream.Context(), filter.Namespaces); err != nil {
+		return err
+	}
+	var backfill time.Duration
+	if req.Backfill != nil {
+		if err := req.Backfill.CheckValid(); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid backfill: %v", err)
+		}
+		if backfill = req.Backfill.AsDuration(); backfill < 0 {
+			return status.Error(codes.InvalidArgument, "backfill must not be negative")
+		}
+	}
+
+	// 先订阅再补发，补发期间产生的事件缓存在订阅中，不会丢失。
+	// 非 leader 副本没有采集事件，改为轮询 es 中新写入的事件
+	start := time.Now()
+	sub, err := s.broadcaster.Subscribe()
+	if err == nil {
+		defer sub.Close()
+	}
+
+	var sent map[string]bool
+	if backfill > 0 {
+		if sent, err = s.backfill(stream, &filter, start.Add(-backfill)); err != nil {
+			return err
+		}
+	}
+	if sub == nil {
+		return s.poll(stream, &filter, start, sent)
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-sub.Done():
+			switch sub.Err() {
+			case broadcast.ErrSlowConsumer:
+				return status.Error(codes.ResourceExhausted, "subscriber is too slow to receive events, buffer is full")
+			case broadcast.ErrStopped:
+				return status.Error(codes.Unavailable, "event collection stopped on this replica")
+			}
+			return nil
+		case event := <-sub.Events():
+			if !filter.Match(event) {
+				continue
+			}
+			doc := elasticsearch.NewEventDocument(event)
+			if sent[watchKey(doc)] {
+				continue
+			}
+			if err := stream.Send(&eventgrpc.WatchEventsResponse{Event: toEvent(doc)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// backfill 按时间升序发送 since 之后已经写入 es 的事件，返回已发送事件的 key，用于跳过订阅中重复的事件
+func (s *searchK8sEventServer) backfill(stream eventgrpc.SearchEventService_WatchEventsServer, filter *elasticsearch.EventFilter, since time.Time) (map[string]bool, error) {
+	sent := map[string]bool{}
+	query := &elasticsearch.EventQuery{
+		Filter:    *filter,
+		Since:     since,
+		PageSize:  maxPageSize,
+		Ascending: true,
+	}
+	for len(sent) < maxBackfillEvents {
+		result, err := s.backend.SearchEvents(stream.Context(), query)
+		if err != nil {
+			return nil, s.backendError(err)
+		}
+		for _, doc := range result.Documents {
+			sent[watchKey(doc)] = true
+			if err := stream.Send(&eventgrpc.WatchEventsResponse{Event: toEvent(doc), Backfill: true}); err != nil {
+				return nil, err
+			}
+		}
+		if result.NextPageToken == "" {
+			break
+		}
+		query.PageToken = result.NextPageToken
+	}
+	return sent, nil
+}
+
+// poll 定期查询 start 之后写入 es 的事件并按时间升序发送，用 watchKey 跳过已经发送的事件。
+// 比 leader 推送的延迟高，写入 es 的延迟超过回看窗口的事件会被漏掉
+func (s *searchK8sEventServer) poll(stream eventgrpc.SearchEventService_WatchEventsServer, filter *elasticsearch.EventFilter, start time.Time, backfilled map[string]bool) error {
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	// 已发送事件的 key 和发生时间，超出回看窗口后清理
+	seen := map[string]time.Time{}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-ticker.C:
+		}
+
+		since := time.Now().Add(-watchPollLookback)
+		for key, t := range seen {
+			if t.Before(since) {
+				delete(seen, key)
+			}
+		}
+		if since.Before(start) {
+			since = start
+		}
+		query := &elasticsearch.EventQuery{
+			Filter:    *filter,
+			Since:     since,
+			PageSize:  maxPageSize,
+			Ascending: true,
+		}
+		for {
+			result, err := s.backend.SearchEvents(stream.Context(), query)
+			if err != nil {
+				return s.backendError(err)
+			}
+			for _, doc := range result.Documents {
+				key := watchKey(doc)
+				if _, ok := seen[key]; ok || backfilled[key] {
+					continue
+				}
+				seen[key] = doc.Timestamp.Time
+				if err := stream.Send(&eventgrpc.WatchEventsResponse{Event: toEvent(doc)}); err != nil {
+					return err
+				}
+			}
+			if result.NextPageToken == "" {
+				break
+			}
+			query.PageToken = result.NextPageToken
+		}
+	}
+}
+
+// watchKey 标识事件的一个版本，每次更新 Count 都会增加
+func watchKey(doc *elasticsearch.EventDocument) string {
+	return fmt.Sprintf("%s/%s/%d", doc.InvolvedObjectNamespace, doc.Name, doc.Count)
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/elasticsearch"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// workloadChildren 是各类工作负载直接管理的对象类型
+var workloadChildren = map[string][]string{
+	"Deployment":  {"ReplicaSet"},
+	"ReplicaSet":  {"Pod"},
+	"StatefulSet": {"Pod"},
+	"DaemonSet":   {"Pod"},
+	"Job":         {"Pod"},
+	"CronJob":     {"Job"},
+}
+
+// workloadResources 是下属对象类型对应的 API 资源，用于检查调用方的权限
+var workloadResources = map[string]schema.GroupResource{
+	"ReplicaSet": {Group: "apps", Resource: "replicasets"},
+	"Pod":        {Resource: "pods"},
+	"Job":        {Group: "batch", Resource: "jobs"},
+}
+
+func isWorkloadKind(kind string) bool {
+	_, ok := workloadChildren[kind]
+	return ok && kind != "ReplicaSet"
+}
+
+// resolveWorkload 从 apiserver 查询工作负载当前的下属对象，例如 Deployment 下的 ReplicaSet 和 Pod。
+// 工作负载已经被删除时返回空列表，只能依赖 enrich 记录的 workload 查询
+func resolveWorkload(ctx context.Context, client kubernetes.Interface, namespace, kind, name string) ([]elasticsearch.ObjectRef, error) {
+	if !isWorkloadKind(kind) {
+		return nil, fmt.Errorf("unsupported workload kind %q, must be Deployment, StatefulSet, DaemonSet, Job or CronJob", kind)
+	}
+
+	root, err := getObject(ctx, client, namespace, kind, name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// 每种类型只 list 一次
+	cache := map[string][]metav1.Object{}
+	list := func(kind string) ([]metav1.Object, error) {
+		if objs, ok := cache[kind]; ok {
+			return objs, nil
+		}
+		objs, err := listObjects(ctx, client, namespace, kind)
+		if err != nil {
+			return nil, err
+		}
+		cache[kind] = objs
+		return objs, nil
+	}
+
+	var refs []elasticsearch.ObjectRef
+	type node struct {
+		kind string
+		uid  types.UID
+	}
+	queue := []node{{kind: kind, uid: root.GetUID()}}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, childKind := range workloadChildren[parent.kind] {
+			children, err := list(childKind)
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range children {
+				owner := metav1.GetControllerOf(child)
+				if owner == nil || owner.UID != parent.uid {
+					continue
+				}
+				refs = append(refs, elasticsearch.ObjectRef{Kind: childKind, Name: child.GetName()})
+				queue = append(queue, node{kind: childKind, uid: child.GetUID()})
+			}
+		}
+	}
+	return refs, nil
+}
+
+func getObject(ctx context.Context, client kubernetes.Interface, namespace, kind, name string) (metav1.Object, error) {
+	opts := metav1.GetOptions{}
+	switch kind {
+	case "Deployment":
+		return client.AppsV1().Deployments(namespace).Get(ctx, name, opts)
+	case "StatefulSet":
+		return client.AppsV1().StatefulSets(namespace).Get(ctx, name, opts)
+	case "DaemonSet":
+		return client.AppsV1().DaemonSets(namespace).Get(ctx, name, opts)
+	case "Job":
+		return client.BatchV1().Jobs(namespace).Get(ctx, name, opts)
+	case "CronJob":
+		return client.BatchV1().CronJobs(namespace).Get(ctx, name, opts)
+	}
+	return nil, fmt.Errorf("unsupported workload kind %q", kind)
+}
+
+func listObjects(ctx context.Context, client kubernetes.Interface, namespace, kind string) ([]metav1.Object, error) {
+	opts := metav1.ListOptions{}
+	var list runtime.Object
+	var err error
+	switch kind {
+	case "ReplicaSet":
+		list, err = client.AppsV1().ReplicaSets(namespace).List(ctx, opts)
+	case "Pod":
+		list, err = client.CoreV1().Pods(namespace).List(ctx, opts)
+	case "Job":
+		list, err = client.BatchV1().Jobs(namespace).List(ctx, opts)
+	default:
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]metav1.Object, 0, len(items))
+	for _, item := range items {
+		obj, err := meta.Accessor(item)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
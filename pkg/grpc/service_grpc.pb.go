@@ -23,6 +23,15 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type SearchEventServiceClient interface {
 	GetResourceEvents(ctx context.Context, in *DescribeEventRequest, opts ...grpc.CallOption) (*DescribeEventResponse, error)
+	// 查询工作负载及其下属 ReplicaSet、Job、Pod 的事件时间线
+	GetWorkloadEvents(ctx context.Context, in *WorkloadEventRequest, opts ...grpc.CallOption) (*WorkloadEventResponse, error)
+	// 按类型、原因、节点、消息内容和标签等条件查询事件
+	SearchEvents(ctx context.Context, in *SearchEventsRequest, opts ...grpc.CallOption) (*SearchEventsResponse, error)
+	// 实时推送新产生的事件，订阅者处理过慢时以 RESOURCE_EXHAUSTED 结束。
+	// 非 leader 副本定期轮询 es 推送新写入的事件，延迟比 leader 高
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (SearchEventService_WatchEventsClient, error)
+	// 按维度和时间统计事件数量
+	GetEventStats(ctx context.Context, in *EventStatsRequest, opts ...grpc.CallOption) (*EventStatsResponse, error)
 }
 
 type searchEventServiceClient struct {
@@ -42,11 +51,79 @@ func (c *searchEventServiceClient) GetResourceEvents(ctx context.Context, in *De
 	return out, nil
 }
 
+func (c *searchEventServiceClient) GetWorkloadEvents(ctx context.Context, in *WorkloadEventRequest, opts ...grpc.CallOption) (*WorkloadEventResponse, error) {
+	out := new(WorkloadEventResponse)
+	err := c.cc.Invoke(ctx, "/grpc.SearchEventService/GetWorkloadEvents", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *searchEventServiceClient) SearchEvents(ctx context.Context, in *SearchEventsRequest, opts ...grpc.CallOption) (*SearchEventsResponse, error) {
+	out := new(SearchEventsResponse)
+	err := c.cc.Invoke(ctx, "/grpc.SearchEventService/SearchEvents", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *searchEventServiceClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (SearchEventService_WatchEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &SearchEventService_ServiceDesc.Streams[0], "/grpc.SearchEventService/WatchEvents", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &searchEventServiceWatchEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type SearchEventService_WatchEventsClient interface {
+	Recv() (*WatchEventsResponse, error)
+	grpc.ClientStream
+}
+
+type searchEventServiceWatchEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *searchEventServiceWatchEventsClient) Recv() (*WatchEventsResponse, error) {
+	m := new(WatchEventsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *searchEventServiceClient) GetEventStats(ctx context.Context, in *EventStatsRequest, opts ...grpc.CallOption) (*EventStatsResponse, error) {
+	out := new(EventStatsResponse)
+	err := c.cc.Invoke(ctx, "/grpc.SearchEventService/GetEventStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // SearchEventServiceServer is the server API for SearchEventService service.
 // All implementations must embed UnimplementedSearchEventServiceServer
 // for forward compatibility
 type SearchEventServiceServer interface {
 	GetResourceEvents(context.Context, *DescribeEventRequest) (*DescribeEventResponse, error)
+	// 查询工作负载及其下属 ReplicaSet、Job、Pod 的事件时间线
+	GetWorkloadEvents(context.Context, *WorkloadEventRequest) (*WorkloadEventResponse, error)
+	// 按类型、原因、节点、消息内容和标签等条件查询事件
+	SearchEvents(context.Context, *SearchEventsRequest) (*SearchEventsResponse, error)
+	// 实时推送新产生的事件，订阅者处理过慢时以 RESOURCE_EXHAUSTED 结束。
+	// 非 leader 副本定期轮询 es 推送新写入的事件，延迟比 leader 高
+	WatchEvents(*WatchEventsRequest, SearchEventService_WatchEventsServer) error
+	// 按维度和时间统计事件数量
+	GetEventStats(context.Context, *EventStatsRequest) (*EventStatsResponse, error)
 	mustEmbedUnimplementedSearchEventServiceServer()
 }
 
@@ -57,6 +134,18 @@ type UnimplementedSearchEventServiceServer struct {
 func (UnimplementedSearchEventServiceServer) GetResourceEvents(context.Context, *DescribeEventRequest) (*DescribeEventResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetResourceEvents not implemented")
 }
+func (UnimplementedSearchEventServiceServer) GetWorkloadEvents(context.Context, *WorkloadEventRequest) (*WorkloadEventResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetWorkloadEvents not implemented")
+}
+func (UnimplementedSearchEventServiceServer) SearchEvents(context.Context, *SearchEventsRequest) (*SearchEventsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SearchEvents not implemented")
+}
+func (UnimplementedSearchEventServiceServer) WatchEvents(*WatchEventsRequest, SearchEventService_WatchEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedSearchEventServiceServer) GetEventStats(context.Context, *EventStatsRequest) (*EventStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetEventStats not implemented")
+}
 func (UnimplementedSearchEventServiceServer) mustEmbedUnimplementedSearchEventServiceServer() {}
 
 // UnsafeSearchEventServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -88,6 +177,81 @@ func _SearchEventService_GetResourceEvents_Handler(srv interface{}, ctx context.
 	return interceptor(ctx, in, info, handler)
 }
 
+func _SearchEventService_GetWorkloadEvents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WorkloadEventRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SearchEventServiceServer).GetWorkloadEvents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.SearchEventService/GetWorkloadEvents",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SearchEventServiceServer).GetWorkloadEvents(ctx, req.(*WorkloadEventRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SearchEventService_SearchEvents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchEventsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SearchEventServiceServer).SearchEvents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.SearchEventService/SearchEvents",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SearchEventServiceServer).SearchEvents(ctx, req.(*SearchEventsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SearchEventService_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SearchEventServiceServer).WatchEvents(m, &searchEventServiceWatchEventsServer{stream})
+}
+
+type SearchEventService_WatchEventsServer interface {
+	Send(*WatchEventsResponse) error
+	grpc.ServerStream
+}
+
+type searchEventServiceWatchEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *searchEventServiceWatchEventsServer) Send(m *WatchEventsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _SearchEventService_GetEventStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EventStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SearchEventServiceServer).GetEventStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.SearchEventService/GetEventStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SearchEventServiceServer).GetEventStats(ctx, req.(*EventStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // SearchEventService_ServiceDesc is the grpc.ServiceDesc for SearchEventService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -99,7 +263,25 @@ var SearchEventService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetResourceEvents",
 			Handler:    _SearchEventService_GetResourceEvents_Handler,
 		},
+		{
+			MethodName: "GetWorkloadEvents",
+			Handler:    _SearchEventService_GetWorkloadEvents_Handler,
+		},
+		{
+			MethodName: "SearchEvents",
+			Handler:    _SearchEventService_SearchEvents_Handler,
+		},
+		{
+			MethodName: "GetEventStats",
+			Handler:    _SearchEventService_GetEventStats_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _SearchEventService_WatchEvents_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/grpc/service.proto",
 }
@@ -3,6 +3,13 @@ package metrics
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+const (
+	BulkResultSuccess = "success"
+	BulkResultFailed  = "failed"
+	BulkResultRetried = "retried"
 )
 
 var (
@@ -12,9 +19,132 @@ var (
 			Name: "search_event_server_total",
 			Help: "call grpc interface total",
 		},[]string{"eventNamespace"})
+
+	BulkBatchSize = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Subsystem: "k8s_event",
+			Name:      "es_bulk_batch_size",
+			Help:      "number of documents sent in one bulk request",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		})
+
+	BulkFlushLatency = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Subsystem: "k8s_event",
+			Name:      "es_bulk_flush_duration_seconds",
+			Help:      "latency of bulk requests",
+			Buckets:   prometheus.DefBuckets,
+		})
+
+	BulkItemsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "k8s_event",
+			Name:      "es_bulk_items_total",
+			Help:      "bulk indexed documents by result",
+		}, []string{"result"})
+
+	BulkQueueLength = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "k8s_event",
+			Name:      "es_bulk_queue_length",
+			Help:      "documents waiting to be added into a bulk request",
+		})
+
+	FilterDroppedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "k8s_event",
+			Name:      "filter_dropped_total",
+			Help:      "events dropped by filter rules before enqueueing",
+		}, []string{"rule"})
+
+	WALBufferedBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "k8s_event",
+			Name:      "wal_buffered_bytes",
+			Help:      "bytes of events buffered on disk waiting to be delivered to the sink",
+		})
+
+	WALOldestEntryAge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "k8s_event",
+			Name:      "wal_oldest_entry_age_seconds",
+			Help:      "age of the oldest event buffered on disk",
+		})
+
+	WALDroppedEventsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: "k8s_event",
+			Name:      "wal_dropped_events_total",
+			Help:      "buffered events dropped because the sink rejected them permanently",
+		})
+
+	Leader = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "k8s_event",
+			Name:      "leader",
+			Help:      "1 if this replica is the leader collecting events",
+		})
+
+	WatchSubscribers = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "k8s_event",
+			Name:      "watch_subscribers",
+			Help:      "number of active WatchEvents subscribers",
+		})
+
+	WatchDroppedSubscribersTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: "k8s_event",
+			Name:      "watch_dropped_subscribers_total",
+			Help:      "number of WatchEvents subscribers dropped because their buffer was full",
+		})
 )
 
 func AddSearchK8sEventServerTotal(eventNamespace string){
 	SearchK8sEventServerTotal.WithLabelValues(eventNamespace).Inc()
 }
 
+func ObserveBulkFlush(size int, latency time.Duration) {
+	BulkBatchSize.Observe(float64(size))
+	BulkFlushLatency.Observe(latency.Seconds())
+}
+
+func AddBulkItems(result string, count int) {
+	BulkItemsTotal.WithLabelValues(result).Add(float64(count))
+}
+
+func SetBulkQueueLength(length int) {
+	BulkQueueLength.Set(float64(length))
+}
+
+func AddFilterDropped(rule string) {
+	FilterDroppedTotal.WithLabelValues(rule).Inc()
+}
+
+func SetLeader(leader bool) {
+	if leader {
+		Leader.Set(1)
+		return
+	}
+	Leader.Set(0)
+}
+
+func SetWALBufferedBytes(size int64) {
+	WALBufferedBytes.Set(float64(size))
+}
+
+func SetWALOldestEntryAge(age time.Duration) {
+	WALOldestEntryAge.Set(age.Seconds())
+}
+
+func AddWALDroppedEvents() {
+	WALDroppedEventsTotal.Inc()
+}
+
+func SetWatchSubscribers(count int) {
+	WatchSubscribers.Set(float64(count))
+}
+
+func AddWatchDroppedSubscribers() {
+	WatchDroppedSubscribersTotal.Inc()
+}
@@ -3,26 +3,112 @@ package options
 import (
 	"flag"
 	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/auth"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/checkpoint"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/elasticsearch"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/election"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/enrich"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/filter"
+	grpcserver "github.com/jiangzhiheng/k8s-event-collector/pkg/grpc/server"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/wal"
 	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/klog/v2"
 	"os"
+	"strings"
+	"time"
+)
+
+// 监听的事件 API
+const (
+	EventAPICore   = "core"
+	EventAPIEvents = "events"
+	EventAPIBoth   = "both"
 )
 
 type Options struct {
 	KubeMasterURL  string
 	KubeConfigPath string
 	EventType      []string
-	ESEndpoint     []string
-	ESUsername     string
-	ESPassword     string
-	MetricsPort    int
-	UseGRPC        bool
-	UseHTTP        bool
-	flag           *pflag.FlagSet
+	// field=pattern 格式的过滤规则
+	IncludeFilter []string
+	ExcludeFilter []string
+	// 只监听这些 namespace，或者标签匹配选择器的 namespace，都为空时监听所有 namespace
+	Namespaces        []string
+	NamespaceSelector string
+	// core、events 或 both，both 时按 UID 和 ResourceVersion 去重
+	EventAPI   string
+	ESEndpoint []string
+	ESUsername string
+	ESPassword string
+	// 敏感信息从文件或环境变量读取，避免出现在命令行中
+	ESPasswordFile       string
+	ESAPIKeyFile         string
+	ESServiceTokenFile   string
+	ESAPIKey             string
+	ESServiceToken       string
+	ESCloudID            string
+	ESCACert             string
+	ESClientCert         string
+	ESClientKey          string
+	ESInsecureSkipVerify bool
+	// 后端发行版和版本，默认启动后自动探测
+	ESDistribution string
+	ESVersion      string
+	// es bulk 写入配置
+	ESBulkEnabled       bool
+	ESBulkActions       int
+	ESBulkSize          int
+	ESBulkFlushInterval time.Duration
+	ESBulkQueueSize     int
+	ESBulkMaxRetries    int
+	// es 文档写入模式：latest 或 history
+	ESDocumentMode string
+	// es 索引、模板和 ILM 策略配置
+	ESIndex elasticsearch.IndexConfig
+	// 为事件补充涉及对象的 owner、标签、节点和镜像
+	Enrich            bool
+	EnrichLabels      []string
+	EnrichAnnotations []string
+	// 磁盘缓冲区目录，为空时不启用
+	WALDir          string
+	WALMaxBytes     int64
+	WALSegmentBytes int64
+	// 已写入事件的 checkpoint，保存到文件或 namespace/name 格式的 ConfigMap
+	CheckpointFile      string
+	CheckpointConfigMap string
+	CheckpointInterval  time.Duration
+	// 多副本部署时基于 Lease 选主，只有 leader 采集事件
+	LeaderElect              bool
+	LeaderElectNamespace     string
+	LeaderElectName          string
+	LeaderElectLeaseDuration time.Duration
+	LeaderElectRenewDeadline time.Duration
+	LeaderElectRetryPeriod   time.Duration
+	MetricsPort              int
+	UseGRPC                  bool
+	GRPCAddress              string
+	GRPCTLSCert              string
+	GRPCTLSKey               string
+	GRPCClientCA             string
+	GRPCMaxRecvMsgSize       int
+	GRPCMaxSendMsgSize       int
+	GRPCKeepaliveTime        time.Duration
+	GRPCKeepaliveTimeout     time.Duration
+	GRPCKeepaliveMinTime     time.Duration
+	GRPCAuth                 bool
+	GRPCAuthAudiences        []string
+	GRPCAuthCacheTTL         time.Duration
+	WatchBufferSize          int
+	UseHTTP                  bool
+	flag                     *pflag.FlagSet
+	filter                   *filter.Filter
 }
 
 func NewOptions() *Options {
-	return &Options{}
+	return &Options{
+		ESIndex: elasticsearch.DefaultIndexConfig(),
+	}
 }
 
 func (o *Options) AddFlags() {
@@ -33,11 +119,75 @@ func (o *Options) AddFlags() {
 
 	o.flag.StringVar(&o.KubeMasterURL, "kubeMasterURL", "", "The URL of kubernetes apiserver to use as a master")
 	o.flag.StringVar(&o.KubeConfigPath, "kubeConfigPath", "", "The path of kubernetes configuration file")
+	o.flag.StringArrayVar(&o.EventType, "eventType", nil, "Only collect events of this type, e.g. Warning. Can be repeated, empty collects all types.")
+	o.flag.StringArrayVar(&o.IncludeFilter, "includeFilter", nil, "Only collect events matching field=pattern, field is one of type, reason, kind, namespace, message or component. pattern is a glob, or a regex when wrapped in /.../. Can be repeated.")
+	o.flag.StringArrayVar(&o.ExcludeFilter, "excludeFilter", nil, "Drop events matching field=pattern, same format as includeFilter. Can be repeated.")
+	o.flag.StringSliceVar(&o.Namespaces, "namespaces", nil, "Comma separated namespaces to collect events from, with one watch per namespace. Empty collects from all namespaces.")
+	o.flag.StringVar(&o.NamespaceSelector, "namespaceSelector", "", "Collect events from namespaces matching this label selector, e.g. team=a. Namespaces are added and removed as their labels change.")
+	o.flag.StringVar(&o.EventAPI, "eventAPI", EventAPICore, "Event API to watch: core for core/v1, events for events.k8s.io/v1, both watches the two and de-duplicates events seen through both.")
 	o.flag.StringArrayVar(&o.ESEndpoint, "esEndpoint", []string{""}, "List of es endpoints.")
 	o.flag.StringVar(&o.ESUsername, "esUsername", "elastic", "elastic username")
-	o.flag.StringVar(&o.ESPassword, "esPassword", "", "elastic password.")
+	o.flag.StringVar(&o.ESPassword, "esPassword", "", "elastic password, prefer esPasswordFile or the ES_PASSWORD env.")
+	o.flag.StringVar(&o.ESPasswordFile, "esPasswordFile", "", "File containing the elastic password.")
+	o.flag.StringVar(&o.ESAPIKeyFile, "esAPIKeyFile", "", "File containing a base64 encoded elastic api key, overrides username and password. Can also be set with the ES_API_KEY env.")
+	o.flag.StringVar(&o.ESServiceTokenFile, "esServiceTokenFile", "", "File containing an elastic service account token. Can also be set with the ES_SERVICE_TOKEN env.")
+	o.flag.StringVar(&o.ESCloudID, "esCloudID", "", "Elastic Cloud ID, used instead of esEndpoint. Can also be set with the ES_CLOUD_ID env.")
+	o.flag.StringVar(&o.ESCACert, "esCACert", "", "PEM file of the CA that signed the elastic server certificate.")
+	o.flag.StringVar(&o.ESClientCert, "esClientCert", "", "PEM client certificate file for elastic tls authentication.")
+	o.flag.StringVar(&o.ESClientKey, "esClientKey", "", "PEM client key file for elastic tls authentication.")
+	o.flag.BoolVar(&o.ESInsecureSkipVerify, "esInsecureSkipVerify", false, "Skip verifying the elastic server certificate.")
+	o.flag.StringVar(&o.ESDistribution, "esDistribution", elasticsearch.DistributionAuto, "Storage backend distribution: auto, elasticsearch or opensearch. auto detects it from the server.")
+	o.flag.StringVar(&o.ESVersion, "esVersion", "", "Storage backend version used when esDistribution is not auto, e.g. 7.17.0. Defaults to the latest supported major.")
+	o.flag.BoolVar(&o.ESBulkEnabled, "esBulkEnabled", true, "Write events to elastic with the bulk api.")
+	o.flag.IntVar(&o.ESBulkActions, "esBulkActions", 500, "Flush a bulk request once it holds this many documents.")
+	o.flag.IntVar(&o.ESBulkSize, "esBulkSize", 5*1024*1024, "Flush a bulk request once its documents reach this many bytes.")
+	o.flag.DurationVar(&o.ESBulkFlushInterval, "esBulkFlushInterval", 5*time.Second, "Flush pending bulk documents at least this often.")
+	o.flag.IntVar(&o.ESBulkQueueSize, "esBulkQueueSize", 1000, "Max documents waiting for a bulk request before writers block.")
+	o.flag.IntVar(&o.ESBulkMaxRetries, "esBulkMaxRetries", 3, "Max retries for a document rejected with 429 or 5xx.")
+	o.flag.StringVar(&o.ESDocumentMode, "esDocumentMode", "latest", "How event updates are stored: latest keeps one document per event, history keeps one document per occurrence.")
+	o.flag.BoolVar(&o.ESIndex.DataStream, "esDataStream", false, "Write events to an elastic data stream instead of daily indices, requires esDocumentMode=history.")
+	o.flag.StringVar(&o.ESIndex.Prefix, "esIndexPrefix", o.ESIndex.Prefix, "Prefix of daily index, data stream and template names; use a distinct prefix per cluster when several clusters share one elastic.")
+	o.flag.IntVar(&o.ESIndex.Shards, "esShards", o.ESIndex.Shards, "Number of primary shards per index, 0 uses the elastic default.")
+	o.flag.IntVar(&o.ESIndex.Replicas, "esReplicas", o.ESIndex.Replicas, "Number of replicas per index, -1 uses the elastic default.")
+	o.flag.StringVar(&o.ESIndex.ILMPolicyName, "esILMPolicy", o.ESIndex.ILMPolicyName, "Name of the ILM policy (ISM policy on OpenSearch) attached to event indices.")
+	o.flag.StringVar(&o.ESIndex.RolloverMaxAge, "esRolloverMaxAge", o.ESIndex.RolloverMaxAge, "Roll over the data stream write index after this age, empty disables the condition.")
+	o.flag.StringVar(&o.ESIndex.RolloverMaxSize, "esRolloverMaxSize", o.ESIndex.RolloverMaxSize, "Roll over the data stream write index once a primary shard reaches this size, e.g. 50gb.")
+	o.flag.Int64Var(&o.ESIndex.RolloverMaxDocs, "esRolloverMaxDocs", o.ESIndex.RolloverMaxDocs, "Roll over the data stream write index after this many documents, 0 disables the condition.")
+	o.flag.StringVar(&o.ESIndex.WarmAfter, "esWarmAfter", o.ESIndex.WarmAfter, "Move indices to the warm phase after this age, empty disables the phase.")
+	o.flag.StringVar(&o.ESIndex.ColdAfter, "esColdAfter", o.ESIndex.ColdAfter, "Move indices to the cold phase after this age, empty disables the phase.")
+	o.flag.StringVar(&o.ESIndex.DeleteAfter, "esDeleteAfter", o.ESIndex.DeleteAfter, "Delete indices after this age, empty keeps them forever.")
+	o.flag.BoolVar(&o.ESIndex.ManageTemplate, "esManageTemplate", o.ESIndex.ManageTemplate, "Create or update the index template before writing, disable when it is managed outside the collector.")
+	o.flag.BoolVar(&o.ESIndex.ManageILM, "esManageILM", o.ESIndex.ManageILM, "Create or update the ILM or ISM policy before writing, disable when it is managed outside the collector.")
+	o.flag.BoolVar(&o.Enrich, "enrich", false, "Attach the owner chain, workload, node, images and allowed labels of the involved object to each event. Caches pods and workloads.")
+	o.flag.StringSliceVar(&o.EnrichLabels, "enrichLabels", []string{"app", "app.kubernetes.io/*"}, "Comma separated globs of involved object labels attached by enrich.")
+	o.flag.StringSliceVar(&o.EnrichAnnotations, "enrichAnnotations", nil, "Comma separated globs of involved object annotations attached by enrich.")
+	o.flag.StringVar(&o.WALDir, "walDir", "", "Directory of an on-disk buffer between the collector and es, so events survive es outages and restarts. Empty disables it.")
+	o.flag.Int64Var(&o.WALMaxBytes, "walMaxBytes", 1024*1024*1024, "Max bytes buffered on disk, events are retried from the informer cache once it is full.")
+	o.flag.Int64Var(&o.WALSegmentBytes, "walSegmentBytes", 64*1024*1024, "Size of one buffer segment file, delivered segments are deleted.")
+	o.flag.StringVar(&o.CheckpointFile, "checkpointFile", "", "File to persist shipped events in, so a restart skips events already written. Use a persistent volume.")
+	o.flag.StringVar(&o.CheckpointConfigMap, "checkpointConfigMap", "", "ConfigMap as namespace/name to persist shipped events in, shared by replicas when leaderElect is enabled.")
+	o.flag.DurationVar(&o.CheckpointInterval, "checkpointInterval", 10*time.Second, "How often the checkpoint is saved.")
+	o.flag.BoolVar(&o.LeaderElect, "leaderElect", false, "Elect a leader with a coordination.k8s.io Lease so only one replica collects events, all replicas keep serving queries.")
+	o.flag.StringVar(&o.LeaderElectNamespace, "leaderElectNamespace", "", "Namespace of the leader election Lease, defaults to the POD_NAMESPACE env or default.")
+	o.flag.StringVar(&o.LeaderElectName, "leaderElectName", "k8s-event-collector", "Name of the leader election Lease.")
+	o.flag.DurationVar(&o.LeaderElectLeaseDuration, "leaderElectLeaseDuration", 15*time.Second, "Duration non-leader replicas wait before trying to take over the Lease.")
+	o.flag.DurationVar(&o.LeaderElectRenewDeadline, "leaderElectRenewDeadline", 10*time.Second, "Duration the leader retries renewing the Lease before giving up leadership.")
+	o.flag.DurationVar(&o.LeaderElectRetryPeriod, "leaderElectRetryPeriod", 2*time.Second, "Duration between leader election attempts.")
 	o.flag.IntVar(&o.MetricsPort, "port", 9102, "Port to expose event metrics on")
 	o.flag.BoolVar(&o.UseGRPC, "useGRPC", true, "enable grpc server")
+	o.flag.StringVar(&o.GRPCAddress, "grpcAddress", ":8112", "Address the grpc server listens on.")
+	o.flag.StringVar(&o.GRPCTLSCert, "grpcTLSCert", "", "PEM certificate file to serve grpc over tls, reloaded when it changes.")
+	o.flag.StringVar(&o.GRPCTLSKey, "grpcTLSKey", "", "PEM key file of grpcTLSCert.")
+	o.flag.StringVar(&o.GRPCClientCA, "grpcClientCA", "", "PEM CA file to verify grpc client certificates with, enables mutual tls. Requires grpcTLSCert.")
+	o.flag.IntVar(&o.GRPCMaxRecvMsgSize, "grpcMaxRecvMsgSize", 4*1024*1024, "Max size in bytes of a grpc request.")
+	o.flag.IntVar(&o.GRPCMaxSendMsgSize, "grpcMaxSendMsgSize", 64*1024*1024, "Max size in bytes of a grpc response.")
+	o.flag.DurationVar(&o.GRPCKeepaliveTime, "grpcKeepaliveTime", 2*time.Hour, "Ping grpc clients after a connection is idle for this long.")
+	o.flag.DurationVar(&o.GRPCKeepaliveTimeout, "grpcKeepaliveTimeout", 20*time.Second, "Close grpc connections whose ping is not acknowledged within this duration.")
+	o.flag.DurationVar(&o.GRPCKeepaliveMinTime, "grpcKeepaliveMinTime", 5*time.Minute, "Minimum interval grpc clients may send keepalive pings at, more frequent clients are disconnected.")
+	o.flag.BoolVar(&o.GRPCAuth, "grpcAuth", false, "Require a kubernetes bearer token on grpc requests, verified with TokenReview, and only return events of namespaces the caller may list events in, checked with SubjectAccessReview. Callers without access to all namespaces must name the namespaces to query.")
+	o.flag.StringSliceVar(&o.GRPCAuthAudiences, "grpcAuthAudiences", nil, "Comma separated audiences grpc bearer tokens must be issued for. Empty uses the apiserver audience.")
+	o.flag.DurationVar(&o.GRPCAuthCacheTTL, "grpcAuthCacheTTL", time.Minute, "How long token reviews and access decisions are cached.")
+	o.flag.IntVar(&o.WatchBufferSize, "watchBufferSize", 1000, "Events buffered for each WatchEvents subscriber, slower subscribers are disconnected.")
 	o.flag.BoolVar(&o.UseHTTP, "useHTTP", true, "enable http server")
 
 	o.flag.Usage = func() {
@@ -47,9 +197,252 @@ func (o *Options) AddFlags() {
 }
 
 func (o *Options) Parse() error {
-	return o.flag.Parse(os.Args)
+	if err := o.flag.Parse(os.Args); err != nil {
+		return err
+	}
+	if err := o.loadSecrets(); err != nil {
+		return err
+	}
+	return o.validate()
+}
+
+// loadSecrets 按 命令行 > 文件 > 环境变量 的优先级读取 es 认证信息
+func (o *Options) loadSecrets() error {
+	secrets := []struct {
+		value *string
+		file  string
+		env   string
+	}{
+		{&o.ESPassword, o.ESPasswordFile, "ES_PASSWORD"},
+		{&o.ESAPIKey, o.ESAPIKeyFile, "ES_API_KEY"},
+		{&o.ESServiceToken, o.ESServiceTokenFile, "ES_SERVICE_TOKEN"},
+		{&o.ESCloudID, "", "ES_CLOUD_ID"},
+	}
+	for _, secret := range secrets {
+		if *secret.value != "" {
+			continue
+		}
+		if secret.file != "" {
+			data, err := os.ReadFile(secret.file)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", secret.file, err)
+			}
+			*secret.value = strings.TrimSpace(string(data))
+			continue
+		}
+		*secret.value = os.Getenv(secret.env)
+	}
+	return nil
+}
+
+func (o *Options) validate() error {
+	if len(o.Namespaces) > 0 && o.NamespaceSelector != "" {
+		return fmt.Errorf("namespaces and namespaceSelector are mutually exclusive")
+	}
+	if o.WALDir != "" && (o.WALMaxBytes <= 0 || o.WALSegmentBytes <= 0) {
+		return fmt.Errorf("walMaxBytes and walSegmentBytes must be positive")
+	}
+	if o.CheckpointFile != "" && o.CheckpointConfigMap != "" {
+		return fmt.Errorf("checkpointFile and checkpointConfigMap are mutually exclusive")
+	}
+	if o.CheckpointConfigMap != "" && len(strings.Split(o.CheckpointConfigMap, "/")) != 2 {
+		return fmt.Errorf("invalid checkpointConfigMap %q, must be namespace/name", o.CheckpointConfigMap)
+	}
+	if o.CheckpointInterval <= 0 {
+		return fmt.Errorf("checkpointInterval must be positive")
+	}
+	if (o.GRPCTLSCert == "") != (o.GRPCTLSKey == "") {
+		return fmt.Errorf("grpcTLSCert and grpcTLSKey must be set together")
+	}
+	if o.GRPCClientCA != "" && o.GRPCTLSCert == "" {
+		return fmt.Errorf("grpcClientCA requires grpcTLSCert and grpcTLSKey")
+	}
+	if o.GRPCMaxRecvMsgSize <= 0 || o.GRPCMaxSendMsgSize <= 0 {
+		return fmt.Errorf("grpcMaxRecvMsgSize and grpcMaxSendMsgSize must be positive")
+	}
+	if o.GRPCAuth && o.GRPCAuthCacheTTL <= 0 {
+		return fmt.Errorf("grpcAuthCacheTTL must be positive")
+	}
+	if o.WatchBufferSize <= 0 {
+		return fmt.Errorf("watchBufferSize must be positive")
+	}
+	if _, err := labels.Parse(o.NamespaceSelector); err != nil {
+		return fmt.Errorf("invalid namespaceSelector %q: %v", o.NamespaceSelector, err)
+	}
+	switch o.EventAPI {
+	case EventAPICore, EventAPIEvents, EventAPIBoth:
+	default:
+		return fmt.Errorf("invalid eventAPI %q, must be core, events or both", o.EventAPI)
+	}
+	switch o.ESDocumentMode {
+	case elasticsearch.DocumentModeLatest, elasticsearch.DocumentModeHistory:
+	default:
+		return fmt.Errorf("invalid esDocumentMode %q, must be latest or history", o.ESDocumentMode)
+	}
+	switch o.ESDistribution {
+	case elasticsearch.DistributionAuto, elasticsearch.DistributionElasticsearch, elasticsearch.DistributionOpenSearch:
+	default:
+		return fmt.Errorf("invalid esDistribution %q, must be auto, elasticsearch or opensearch", o.ESDistribution)
+	}
+	if o.ESIndex.Prefix == "" {
+		return fmt.Errorf("esIndexPrefix must not be empty")
+	}
+	return o.buildFilter()
+}
+
+func (o *Options) buildFilter() error {
+	// eventType 等同于 type 字段的 include 规则
+	includes := append([]string{}, o.IncludeFilter...)
+	for _, eventType := range o.EventType {
+		includes = append(includes, filter.FieldType+"="+eventType)
+	}
+
+	var rules []*filter.Rule
+	for _, exclude := range []bool{false, true} {
+		raw := includes
+		if exclude {
+			raw = o.ExcludeFilter
+		}
+		for _, r := range raw {
+			rule, err := filter.ParseRule(r, exclude)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+	}
+	o.filter = filter.New(rules...)
+	return nil
+}
+
+// EventFilter 返回入队前使用的事件过滤器，未配置规则时放行所有事件
+func (o *Options) EventFilter() *filter.Filter {
+	return o.filter
+}
+
+// EventAPIs 返回需要监听的事件 API 列表
+func (o *Options) EventAPIs() []string {
+	switch o.EventAPI {
+	case EventAPIEvents:
+		return []string{EventAPIEvents}
+	case EventAPIBoth:
+		return []string{EventAPICore, EventAPIEvents}
+	}
+	return []string{EventAPICore}
 }
 
 func (o *Options) Usage() {
 	o.flag.Usage()
 }
+
+// EnrichConfig 返回 enrich 配置
+func (o *Options) EnrichConfig() *enrich.Config {
+	return &enrich.Config{
+		Enabled:             o.Enrich,
+		Namespaced:          len(o.Namespaces) > 0 || o.NamespaceSelector != "",
+		LabelAllowlist:      o.EnrichLabels,
+		AnnotationAllowlist: o.EnrichAnnotations,
+	}
+}
+
+// WALConfig 返回磁盘缓冲区配置，未启用时返回 nil
+func (o *Options) WALConfig() *wal.Config {
+	if o.WALDir == "" {
+		return nil
+	}
+	cfg := wal.DefaultConfig()
+	cfg.Dir = o.WALDir
+	cfg.MaxBytes = o.WALMaxBytes
+	cfg.SegmentBytes = o.WALSegmentBytes
+	return cfg
+}
+
+// CheckpointConfig 返回 checkpoint 的保存位置
+func (o *Options) CheckpointConfig() *checkpoint.Config {
+	cfg := &checkpoint.Config{
+		File:     o.CheckpointFile,
+		Interval: o.CheckpointInterval,
+	}
+	if parts := strings.Split(o.CheckpointConfigMap, "/"); len(parts) == 2 {
+		cfg.ConfigMapNamespace, cfg.ConfigMapName = parts[0], parts[1]
+	}
+	return cfg
+}
+
+// ElectionConfig 返回选主配置，身份使用 POD_NAME 环境变量或主机名
+func (o *Options) ElectionConfig() (*election.Config, error) {
+	namespace := o.LeaderElectNamespace
+	if namespace == "" {
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get hostname: %v", err)
+		}
+		identity = hostname
+	}
+	return &election.Config{
+		Enabled:       o.LeaderElect,
+		Namespace:     namespace,
+		Name:          o.LeaderElectName,
+		Identity:      identity,
+		LeaseDuration: o.LeaderElectLeaseDuration,
+		RenewDeadline: o.LeaderElectRenewDeadline,
+		RetryPeriod:   o.LeaderElectRetryPeriod,
+	}, nil
+}
+
+// GRPCConfig 返回 grpc 服务的配置
+func (o *Options) GRPCConfig() *grpcserver.Config {
+	return &grpcserver.Config{
+		Address:          o.GRPCAddress,
+		TLSCertFile:      o.GRPCTLSCert,
+		TLSKeyFile:       o.GRPCTLSKey,
+		ClientCAFile:     o.GRPCClientCA,
+		MaxRecvMsgSize:   o.GRPCMaxRecvMsgSize,
+		MaxSendMsgSize:   o.GRPCMaxSendMsgSize,
+		KeepaliveTime:    o.GRPCKeepaliveTime,
+		KeepaliveTimeout: o.GRPCKeepaliveTimeout,
+		KeepaliveMinTime: o.GRPCKeepaliveMinTime,
+	}
+}
+
+// AuthConfig 返回 grpc 认证和鉴权的配置
+func (o *Options) AuthConfig() *auth.Config {
+	return &auth.Config{
+		Enabled:   o.GRPCAuth,
+		Audiences: o.GRPCAuthAudiences,
+		CacheTTL:  o.GRPCAuthCacheTTL,
+	}
+}
+
+// ESConfig 返回连接 es 使用的配置
+func (o *Options) ESConfig() *elasticsearch.ESConfig {
+	// esEndpoint 默认值为空字符串，使用 Cloud ID 时不能同时设置地址
+	var hosts []string
+	for _, endpoint := range o.ESEndpoint {
+		if endpoint != "" {
+			hosts = append(hosts, endpoint)
+		}
+	}
+	return &elasticsearch.ESConfig{
+		Hosts:              hosts,
+		Username:           o.ESUsername,
+		Password:           o.ESPassword,
+		CloudID:            o.ESCloudID,
+		APIKey:             o.ESAPIKey,
+		ServiceToken:       o.ESServiceToken,
+		CACertFile:         o.ESCACert,
+		ClientCertFile:     o.ESClientCert,
+		ClientKeyFile:      o.ESClientKey,
+		InsecureSkipVerify: o.ESInsecureSkipVerify,
+		Distribution:       o.ESDistribution,
+		ServerVersion:      o.ESVersion,
+		Index:              o.ESIndex,
+	}
+}
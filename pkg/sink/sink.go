@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	v1api "k8s.io/api/core/v1"
+)
+
+// Event 是投递给 sink 的事件，Enrichment 为采集时补充的涉及对象信息，未开启时为 nil
+type Event struct {
+	*v1api.Event
+	Enrichment *Enrichment `json:"enrichment,omitempty"`
+}
+
+// Enrichment 描述事件涉及对象的元数据
+type Enrichment struct {
+	// 按允许列表筛选后的标签和注解
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// 从直接 owner 到最上层 owner 的链路，例如 ReplicaSet/foo-7d9c、Deployment/foo
+	Owners []OwnerReference `json:"owners,omitempty"`
+	// 最上层的 owner，没有 owner 时为对象本身
+	Workload OwnerReference `json:"workload"`
+	NodeName string         `json:"nodeName,omitempty"`
+	Images   []string       `json:"images,omitempty"`
+}
+
+type OwnerReference struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+func (r OwnerReference) String() string {
+	return r.Kind + "/" + r.Name
+}
+
+// Sink 是事件投递的目的端，EventCollector 会把每个事件分发给所有注册的 Sink。
+// 新增投递目的端时只需实现该接口，不需要改动 collector 的 worker 逻辑。
+type Sink interface {
+	// Name 返回 sink 名称，用于日志和指标
+	Name() string
+	// Write 投递一个事件，返回 error 表示该事件投递失败
+	Write(ctx context.Context, event *Event) error
+	// Flush 将缓冲中的数据全部写出
+	Flush(ctx context.Context) error
+	// Close 释放 sink 持有的资源，调用前应先 Flush
+	Close() error
+	// Healthy 检查目的端是否可用
+	Healthy(ctx context.Context) error
+}
+
+// FailureHandler 接收异步写入最终失败、需要重新投递的事件
+type FailureHandler func(event *Event, err error)
+
+// AsyncSink 是异步写入的 Sink：Write 返回 nil 只代表事件已被接收，
+// 之后写入失败且可以重试的事件通过 FailureHandler 通知调用方
+type AsyncSink interface {
+	Sink
+	SetFailureHandler(handler FailureHandler)
+}
+
+// permanentError 表示目的端拒绝了事件，重试也不会成功，例如字段映射冲突
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent 将写入错误标记为不可重试，调用方记录后跳过该事件
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent 判断写入错误是否不可重试
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
@@ -0,0 +1,463 @@
+package wal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/metrics"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
+	"hash/crc32"
+	"io"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentPrefix = "wal-"
+	segmentSuffix = ".log"
+	positionFile  = "position"
+	// 每条记录的头部：4 字节长度 + 4 字节 crc32
+	headerSize = 8
+)
+
+var (
+	// ErrFull 表示缓冲区已满，调用方需要稍后重试
+	ErrFull   = errors.New("write-ahead buffer is full")
+	ErrClosed = errors.New("write-ahead buffer is closed")
+)
+
+type Config struct {
+	Dir string
+	// 所有未投递记录的最大字节数，超过后拒绝写入
+	MaxBytes int64
+	// 单个分段文件的大小，投递完的分段会被删除
+	SegmentBytes int64
+	// 每次从缓冲区取出投递的记录数
+	BatchSize int
+	// 投递失败后的重试间隔
+	RetryInterval time.Duration
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		MaxBytes:      1024 * 1024 * 1024,
+		SegmentBytes:  64 * 1024 * 1024,
+		BatchSize:     500,
+		RetryInterval: 5 * time.Second,
+	}
+}
+
+type record struct {
+	Time  time.Time   `json:"time"`
+	Event *sink.Event `json:"event"`
+}
+
+// position 是下一条待投递记录的位置
+type position struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// Sink 将事件先写入磁盘上的 write-ahead 缓冲区，再由后台协程按顺序投递到下游 sink。
+// 下游不可用时事件保留在磁盘上，恢复后继续投递，进程重启后从上次投递的位置继续
+type Sink struct {
+	inner sink.Sink
+	cfg   *Config
+
+	locker sync.Mutex
+	// 当前写入的分段
+	writer      *os.File
+	writeSeq    int64
+	writeOffset int64
+	// 已投递的位置
+	read position
+	// 未投递的字节数
+	size int64
+
+	notify chan struct{}
+	stopCh chan struct{}
+	doneCh chan struct{}
+	once   sync.Once
+}
+
+func NewSink(inner sink.Sink, cfg *Config) (*Sink, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create wal dir %s: %v", cfg.Dir, err)
+	}
+	s := &Sink{
+		inner:  inner,
+		cfg:    cfg,
+		notify: make(chan struct{}, 1),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	// 下游异步写入失败的事件重新写入缓冲区
+	if as, ok := inner.(sink.AsyncSink); ok {
+		as.SetFailureHandler(func(event *sink.Event, err error) {
+			if err := s.Write(context.Background(), event); err != nil {
+				klog.Errorf("re-buffer event %s/%s failed: %v", event.Namespace, event.Name, err)
+			}
+		})
+	}
+	go s.run()
+	return s, nil
+}
+
+// open 读取已有分段和投递位置。上次写入的分段尾部可能不完整，总是新建分段写入
+func (s *Sink) open() error {
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.cfg.Dir, positionFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &s.read); err != nil {
+			return fmt.Errorf("failed to parse wal position: %v", err)
+		}
+	case os.IsNotExist(err):
+		if len(segments) > 0 {
+			s.read = position{Segment: segments[0]}
+		}
+	default:
+		return fmt.Errorf("failed to read wal position: %v", err)
+	}
+
+	for _, seq := range segments {
+		if seq < s.read.Segment {
+			continue
+		}
+		info, err := os.Stat(s.segmentPath(seq))
+		if err != nil {
+			return err
+		}
+		s.size += info.Size()
+	}
+	s.size -= s.read.Offset
+
+	s.writeSeq = s.read.Segment
+	if len(segments) > 0 && segments[len(segments)-1] >= s.writeSeq {
+		s.writeSeq = segments[len(segments)-1] + 1
+	}
+	if err := s.rotate(s.writeSeq); err != nil {
+		return err
+	}
+	if s.size > 0 {
+		klog.Infof("wal has %d bytes to replay", s.size)
+	}
+	metrics.SetWALBufferedBytes(s.size)
+	return nil
+}
+
+func (s *Sink) segments() ([]int64, error) {
+	entries, err := os.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wal dir %s: %v", s.cfg.Dir, err)
+	}
+	var segments []int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (s *Sink) segmentPath(seq int64) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%s%016d%s", segmentPrefix, seq, segmentSuffix))
+}
+
+func (s *Sink) rotate(seq int64) error {
+	if s.writer != nil {
+		if err := s.writer.Sync(); err != nil {
+			return err
+		}
+		if err := s.writer.Close(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open wal segment: %v", err)
+	}
+	s.writer, s.writeSeq, s.writeOffset = f, seq, 0
+	return nil
+}
+
+func (s *Sink) Name() string {
+	return s.inner.Name()
+}
+
+// Write 将事件追加到缓冲区，写入成功即返回，不等待下游投递
+func (s *Sink) Write(_ context.Context, event *sink.Event) error {
+	payload, err := json.Marshal(&record{Time: time.Now(), Event: event})
+	if err != nil {
+		return fmt.Errorf("error marshaling event: %s", err)
+	}
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[headerSize:], payload)
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.writer == nil {
+		return ErrClosed
+	}
+	if s.size+int64(len(buf)) > s.cfg.MaxBytes {
+		return ErrFull
+	}
+	if s.writeOffset > 0 && s.writeOffset+int64(len(buf)) > s.cfg.SegmentBytes {
+		if err := s.rotate(s.writeSeq + 1); err != nil {
+			return err
+		}
+	}
+	if _, err := s.writer.Write(buf); err != nil {
+		return fmt.Errorf("failed to write wal: %v", err)
+	}
+	s.writeOffset += int64(len(buf))
+	s.size += int64(len(buf))
+	metrics.SetWALBufferedBytes(s.size)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Flush 将缓冲区落盘
+func (s *Sink) Flush(_ context.Context) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.writer == nil {
+		return nil
+	}
+	return s.writer.Sync()
+}
+
+// Close 停止投递并关闭下游 sink 和缓冲区，未投递的记录在下次启动时继续投递
+func (s *Sink) Close() error {
+	s.once.Do(func() {
+		close(s.stopCh)
+	})
+	<-s.doneCh
+
+	// 下游关闭时写入失败的事件仍然可以写回缓冲区
+	if err := s.inner.Close(); err != nil {
+		klog.Errorf("close sink %s failed: %v", s.inner.Name(), err)
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Sync()
+	if closeErr := s.writer.Close(); err == nil {
+		err = closeErr
+	}
+	s.writer = nil
+	return err
+}
+
+func (s *Sink) Healthy(ctx context.Context) error {
+	return s.inner.Healthy(ctx)
+}
+
+func (s *Sink) run() {
+	defer close(s.doneCh)
+	ticker := time.NewTicker(s.cfg.RetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-s.notify:
+		case <-ticker.C:
+		}
+		s.replay()
+	}
+}
+
+// replay 按顺序投递缓冲区中的记录，失败时保留位置，下次重试
+func (s *Sink) replay() {
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+
+		records, next, err := s.readBatch()
+		if err != nil {
+			klog.Errorf("read wal failed: %v", err)
+			return
+		}
+		if len(records) == 0 {
+			if next != s.read {
+				s.commit(next)
+			}
+			metrics.SetWALOldestEntryAge(0)
+			return
+		}
+		metrics.SetWALOldestEntryAge(time.Since(records[0].Time))
+
+		if err := s.deliver(records); err != nil {
+			klog.Warningf("deliver %d buffered events to sink %s failed, will retry: %v", len(records), s.inner.Name(), err)
+			return
+		}
+		s.commit(next)
+	}
+}
+
+func (s *Sink) deliver(records []*record) error {
+	ctx := context.Background()
+	for _, r := range records {
+		if err := s.inner.Write(ctx, r.Event); err != nil {
+			if !sink.IsPermanent(err) {
+				return err
+			}
+			// 下游拒绝的事件重试也不会成功，跳过以免阻塞后面的事件
+			klog.Errorf("drop buffered event %s/%s rejected by sink %s: %v", r.Event.Namespace, r.Event.Name, s.inner.Name(), err)
+			metrics.AddWALDroppedEvents()
+		}
+	}
+	// 下游 flush 成功后才推进投递位置，失败时重复投递，文档 ID 保证不会重复写入
+	return s.inner.Flush(ctx)
+}
+
+// readBatch 从投递位置开始读取最多 BatchSize 条记录，返回读取后的位置
+func (s *Sink) readBatch() ([]*record, position, error) {
+	s.locker.Lock()
+	pos, writeSeq, writeOffset := s.read, s.writeSeq, s.writeOffset
+	s.locker.Unlock()
+
+	var records []*record
+	for len(records) < s.cfg.BatchSize {
+		limit := int64(-1)
+		if pos.Segment == writeSeq {
+			limit = writeOffset
+		}
+		batch, next, complete, err := s.readSegment(pos, limit, s.cfg.BatchSize-len(records))
+		if err != nil {
+			return nil, pos, err
+		}
+		records = append(records, batch...)
+		pos = next
+		// 当前分段读完后切换到下一个分段，正在写入的分段除外
+		if !complete || pos.Segment >= writeSeq {
+			break
+		}
+		pos = position{Segment: pos.Segment + 1}
+	}
+	return records, pos, nil
+}
+
+// readSegment 读取一个分段，complete 表示分段已经读到结尾。limit 为正在写入分段的已写入长度
+func (s *Sink) readSegment(pos position, limit int64, max int) ([]*record, position, bool, error) {
+	f, err := os.Open(s.segmentPath(pos.Segment))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, pos, true, nil
+		}
+		return nil, pos, false, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+		return nil, pos, false, err
+	}
+
+	r := bufio.NewReader(f)
+	var records []*record
+	header := make([]byte, headerSize)
+	for len(records) < max {
+		if limit >= 0 && pos.Offset >= limit {
+			return records, pos, false, nil
+		}
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, pos, false, err
+			}
+			return records, pos, true, nil
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(r, payload); err != nil || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			// 进程异常退出时分段尾部可能不完整，跳过该分段剩余部分
+			klog.Errorf("wal segment %d is corrupted at offset %d, skip the rest of it", pos.Segment, pos.Offset)
+			return records, pos, true, nil
+		}
+		pos.Offset += int64(headerSize + len(payload))
+
+		rec := &record{}
+		if err := json.Unmarshal(payload, rec); err != nil || rec.Event == nil || rec.Event.Event == nil {
+			klog.Errorf("wal segment %d has an invalid record at offset %d, skip it", pos.Segment, pos.Offset)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, pos, false, nil
+}
+
+// commit 保存投递位置并删除已经投递完的分段
+func (s *Sink) commit(next position) {
+	data, _ := json.Marshal(next)
+	path := filepath.Join(s.cfg.Dir, positionFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		klog.Errorf("save wal position failed: %v", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		klog.Errorf("save wal position failed: %v", err)
+		return
+	}
+
+	s.locker.Lock()
+	prev := s.read
+	s.read = next
+	s.size = s.pendingBytes()
+	metrics.SetWALBufferedBytes(s.size)
+	s.locker.Unlock()
+
+	for seq := prev.Segment; seq < next.Segment; seq++ {
+		if err := os.Remove(s.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("remove wal segment %d failed: %v", seq, err)
+		}
+	}
+}
+
+// pendingBytes 计算未投递的字节数，调用方需要持有锁
+func (s *Sink) pendingBytes() int64 {
+	var size int64
+	for seq := s.read.Segment; seq <= s.writeSeq; seq++ {
+		if seq == s.writeSeq {
+			size += s.writeOffset
+			continue
+		}
+		if info, err := os.Stat(s.segmentPath(seq)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size - s.read.Offset
+}
@@ -0,0 +1,313 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"github.com/jiangzhiheng/k8s-event-collector/pkg/sink"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink 记录投递的事件，reject 返回的错误会让对应事件写入失败
+type fakeSink struct {
+	locker  sync.Mutex
+	written []string
+	reject  func(event *sink.Event) error
+}
+
+func (f *fakeSink) Name() string {
+	return "fake"
+}
+
+func (f *fakeSink) Write(_ context.Context, event *sink.Event) error {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	if f.reject != nil {
+		if err := f.reject(event); err != nil {
+			return err
+		}
+	}
+	f.written = append(f.written, event.Name)
+	return nil
+}
+
+func (f *fakeSink) Flush(context.Context) error {
+	return nil
+}
+
+func (f *fakeSink) Close() error {
+	return nil
+}
+
+func (f *fakeSink) Healthy(context.Context) error {
+	return nil
+}
+
+func (f *fakeSink) delivered() []string {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	return append([]string(nil), f.written...)
+}
+
+func testConfig(dir string) *Config {
+	return &Config{
+		Dir:           dir,
+		MaxBytes:      1024 * 1024,
+		SegmentBytes:  1024 * 1024,
+		BatchSize:     10,
+		RetryInterval: 20 * time.Millisecond,
+	}
+}
+
+func testEvent(name string) *sink.Event {
+	return &sink.Event{Event: &v1api.Event{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID("uid-" + name)},
+		Reason:     "Scheduled",
+	}}
+}
+
+// waitFor 等待 cond 成立，超时后失败
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *Sink) buffered() int64 {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.size
+}
+
+func TestReplaySkipsPermanentFailures(t *testing.T) {
+	inner := &fakeSink{reject: func(event *sink.Event) error {
+		if event.Name == "rejected" {
+			return sink.Permanent(errors.New("mapper_parsing_exception"))
+		}
+		return nil
+	}}
+	s, err := NewSink(inner, testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatalf("create wal failed: %v", err)
+	}
+	defer s.Close()
+
+	for _, name := range []string{"rejected", "accepted"} {
+		if err := s.Write(context.Background(), testEvent(name)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	// 被拒绝的事件不能阻塞后面的事件，投递位置需要越过它
+	waitFor(t, func() bool { return s.buffered() == 0 }, "buffer to be committed")
+	if got := inner.delivered(); len(got) != 1 || got[0] != "accepted" {
+		t.Errorf("expected only the accepted event to be delivered, got %v", got)
+	}
+}
+
+func TestReplayRetriesTemporaryFailures(t *testing.T) {
+	var locker sync.Mutex
+	available := false
+	inner := &fakeSink{reject: func(*sink.Event) error {
+		locker.Lock()
+		defer locker.Unlock()
+		if !available {
+			return errors.New("connection refused")
+		}
+		return nil
+	}}
+	s, err := NewSink(inner, testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatalf("create wal failed: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Write(context.Background(), testEvent("pending")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s.buffered() == 0 {
+		t.Fatalf("event was committed while the sink is unavailable")
+	}
+
+	locker.Lock()
+	available = true
+	locker.Unlock()
+	waitFor(t, func() bool { return s.buffered() == 0 }, "buffer to be committed")
+	if got := inner.delivered(); len(got) != 1 || got[0] != "pending" {
+		t.Errorf("expected the buffered event to be delivered once, got %v", got)
+	}
+}
+
+func TestSegmentsRotateAndAreRemovedAfterDelivery(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(dir)
+	// 每个分段只能放下一条记录
+	cfg.SegmentBytes = 64
+	var locker sync.Mutex
+	available := false
+	inner := &fakeSink{reject: func(*sink.Event) error {
+		locker.Lock()
+		defer locker.Unlock()
+		if !available {
+			return errors.New("connection refused")
+		}
+		return nil
+	}}
+	s, err := NewSink(inner, cfg)
+	if err != nil {
+		t.Fatalf("create wal failed: %v", err)
+	}
+	defer s.Close()
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := s.Write(context.Background(), testEvent(name)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	segments, err := s.segments()
+	if err != nil {
+		t.Fatalf("list segments failed: %v", err)
+	}
+	if len(segments) != 3 {
+		t.Fatalf("expected 3 segments, got %v", segments)
+	}
+
+	locker.Lock()
+	available = true
+	locker.Unlock()
+	waitFor(t, func() bool { return s.buffered() == 0 }, "buffer to be committed")
+	if got := inner.delivered(); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("expected events to be delivered in order, got %v", got)
+	}
+	// 投递完的分段被删除，只保留正在写入的分段
+	if segments, _ := s.segments(); len(segments) != 1 {
+		t.Errorf("expected delivered segments to be removed, got %v", segments)
+	}
+}
+
+func TestWriteRejectsWhenFull(t *testing.T) {
+	cfg := testConfig(t.TempDir())
+	cfg.MaxBytes = 1024
+	inner := &fakeSink{reject: func(*sink.Event) error { return errors.New("connection refused") }}
+	s, err := NewSink(inner, cfg)
+	if err != nil {
+		t.Fatalf("create wal failed: %v", err)
+	}
+	defer s.Close()
+
+	written := 0
+	for ; written < 100; written++ {
+		err := s.Write(context.Background(), testEvent("a"))
+		if errors.Is(err, ErrFull) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if written == 0 || written == 100 {
+		t.Fatalf("expected the buffer to fill up after some writes, wrote %d", written)
+	}
+	if size := s.buffered(); size > cfg.MaxBytes {
+		t.Errorf("buffered %d bytes, more than the limit %d", size, cfg.MaxBytes)
+	}
+}
+
+func TestReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	down := &fakeSink{reject: func(*sink.Event) error { return errors.New("connection refused") }}
+	s, err := NewSink(down, testConfig(dir))
+	if err != nil {
+		t.Fatalf("create wal failed: %v", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := s.Write(context.Background(), testEvent(name)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// 重启后从上次的投递位置继续投递
+	inner := &fakeSink{}
+	s, err = NewSink(inner, testConfig(dir))
+	if err != nil {
+		t.Fatalf("reopen wal failed: %v", err)
+	}
+	if s.buffered() == 0 {
+		t.Fatalf("expected buffered events to survive the restart")
+	}
+	if err := s.Write(context.Background(), testEvent("c")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	waitFor(t, func() bool { return len(inner.delivered()) == 3 }, "buffered events to be replayed")
+	waitFor(t, func() bool { return s.buffered() == 0 }, "buffer to be committed")
+	if err := s.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// 已经投递的事件再次重启后不会重复投递
+	again := &fakeSink{}
+	s, err = NewSink(again, testConfig(dir))
+	if err != nil {
+		t.Fatalf("reopen wal failed: %v", err)
+	}
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+	if got := again.delivered(); len(got) != 0 {
+		t.Errorf("expected committed events not to be replayed, got %v", got)
+	}
+}
+
+func TestReplaySkipsCorruptedTail(t *testing.T) {
+	dir := t.TempDir()
+	down := &fakeSink{reject: func(*sink.Event) error { return errors.New("connection refused") }}
+	s, err := NewSink(down, testConfig(dir))
+	if err != nil {
+		t.Fatalf("create wal failed: %v", err)
+	}
+	if err := s.Write(context.Background(), testEvent("a")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	path := s.segmentPath(s.writeSeq)
+	if err := s.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// 模拟写入一半时进程退出：记录头声明的长度超过实际写入的内容
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("open segment failed: %v", err)
+	}
+	if _, err := f.Write([]byte{0, 0, 1, 0, 0xde, 0xad, 0xbe, 0xef, '{'}); err != nil {
+		t.Fatalf("append garbage failed: %v", err)
+	}
+	f.Close()
+
+	inner := &fakeSink{}
+	s, err = NewSink(inner, testConfig(dir))
+	if err != nil {
+		t.Fatalf("reopen wal failed: %v", err)
+	}
+	defer s.Close()
+	if err := s.Write(context.Background(), testEvent("b")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	// 损坏的尾部被跳过，之前完整的记录和新写入的分段都能投递
+	waitFor(t, func() bool { return len(inner.delivered()) == 2 }, "events around the corrupted tail to be delivered")
+	if got := inner.delivered(); got[0] != "a" || got[1] != "b" {
+		t.Errorf("unexpected delivery order %v", got)
+	}
+	waitFor(t, func() bool { return s.buffered() == 0 }, "buffer to be committed")
+}